@@ -3,20 +3,31 @@ package main
 import (
 	"os"
 	"strconv"
+	"strings"
 
 	evbus "github.com/asaskevich/EventBus"
 	. "github.com/mattn/go-getopt"
 	log "github.com/spf13/jwalterweatherman"
 
+	"github.com/mudler/artemide/pkg/build"
 	config "github.com/mudler/artemide/pkg/config"
 	"github.com/mudler/artemide/pkg/context"
+	"github.com/mudler/artemide/pkg/osutil"
+	"github.com/mudler/artemide/pkg/rootfs"
 	plugin "github.com/mudler/artemide/plugin"
 
+	_ "github.com/mudler/artemide/plugin/recipe/archive"
 	_ "github.com/mudler/artemide/plugin/recipe/docker"
+	_ "github.com/mudler/artemide/plugin/recipe/local"
+	_ "github.com/mudler/artemide/plugin/recipe/registry"
 	_ "github.com/mudler/artemide/plugin/recipe/script"
+	_ "github.com/mudler/artemide/plugin/recipe/sdcard"
 )
 
 func main() {
+	// When re-executed to run a command chrooted, this never returns
+	osutil.ChrootInit()
+
 	if os.Getenv("DEBUG") == strconv.Itoa(1) {
 		log.SetStdoutThreshold(log.LevelDebug)
 	} else {
@@ -27,13 +38,28 @@ func main() {
 	var c int
 	var configurationFile string
 	var unpackImage string
-	var context *context.Context
+	ctx := context.New()
 	var outputDir string
+	var workDir string
+	vars := map[string]string{}
+
+	// Modes come first, the options follow
+	if len(os.Args) > 1 && os.Args[1] == "cache" {
+		os.Exit(cacheCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "flatten" {
+		os.Exit(flattenCommand(os.Args[2:]))
+	}
+	var mode string
+	if len(os.Args) > 1 && os.Args[1] == "validate" {
+		mode = os.Args[1]
+		os.Args = append(os.Args[:1], os.Args[2:]...)
+	}
 
 	bus := evbus.New()
 	OptErr = 0
 	for {
-		if c = Getopt("o:u:c:h"); c == EOF {
+		if c = Getopt("o:u:c:w:D:h"); c == EOF {
 			break
 		}
 		switch c {
@@ -43,9 +69,20 @@ func main() {
 			outputDir = OptArg
 		case 'c':
 			configurationFile = OptArg
+		case 'w':
+			workDir = OptArg
+		case 'D':
+			kv := strings.SplitN(OptArg, "=", 2)
+			if len(kv) != 2 {
+				log.ERROR.Fatalln("-D wants name=value, got", OptArg)
+			}
+			vars[kv[0]] = kv[1]
 		case 'h':
-			println("usage: " + os.Args[0] + " [-c config.toml -h]")
+			println("usage: " + os.Args[0] + " [-c config.toml -w workdir -D name=value -h]")
 			println("to just extract a docker image: " + os.Args[0] + " -u docker/image -o /my/uncompressed_rootfs")
+			println("to check a configuration without building: " + os.Args[0] + " validate -c config.toml")
+			println("to list or prune the cache of unpacked images: " + os.Args[0] + " cache ls|prune")
+			println("to squash an image in a single layer: " + os.Args[0] + " flatten docker/image -t newtag")
 			os.Exit(1)
 		}
 	}
@@ -53,12 +90,12 @@ func main() {
 	// Register hooks and recipes to the eventbus
 	for i := range plugin.Hooks {
 		log.DEBUG.Println("Registering", i, "hook to eventbus")
-		plugin.Hooks[i].Register(bus, context)
+		plugin.Hooks[i].Register(bus, ctx)
 	}
 
 	for i := range plugin.Recipes {
 		log.DEBUG.Println("Registering", i, "recipe to eventbus")
-		plugin.Recipes[i].Register(bus, context)
+		plugin.Recipes[i].Register(bus, ctx)
 	}
 
 	// Starting the bus show!
@@ -68,7 +105,20 @@ func main() {
 	if unpackImage != "" && outputDir != "" {
 		// Unpack mode, just unpack the image and exits.
 		log.INFO.Println("Unpack mode. Unpacking", unpackImage, "to", outputDir)
-		bus.Publish("artemide:source:docker", unpackImage, outputDir)
+		ctx.Config = &config.Config{Source: config.Source{Type: "docker", Image: unpackImage}}
+		ctx.Artifact("unpack").Rootfs = outputDir
+		ev := &plugin.Event{Artifact: "unpack", Context: ctx}
+		bus.Publish(plugin.SourceTopic("docker"), ev)
+		if ev.Failed() {
+			log.ERROR.Fatalln(ev.Err)
+		}
+		// Nothing runs in it, what was only needed to build goes right away
+		if err := rootfs.Prepare(outputDir, ctx.Config.Prepare); err != nil {
+			log.ERROR.Fatalln(err)
+		}
+		if err := rootfs.Finalize(outputDir, ctx.Config.Prepare); err != nil {
+			log.ERROR.Fatalln(err)
+		}
 		os.Exit(0)
 	}
 
@@ -77,23 +127,33 @@ func main() {
 		log.ERROR.Fatalln("I can't work without a configuration file")
 	}
 
-	configuration, _ := config.LoadConfig(configurationFile)
+	configuration, err := config.LoadConfig(configurationFile, vars)
+	if err != nil {
+		log.ERROR.Fatalln(err)
+	}
+	if err := configuration.Validate(plugin.Known); err != nil {
+		log.ERROR.Fatalln(err)
+	}
+	if mode == "validate" {
+		log.INFO.Println(configurationFile, "is valid")
+		os.Exit(0)
+	}
 
 	log.DEBUG.Printf("%v\n", configuration)
 
-	//bus.Publish("artemide:source:"+configuration.Source.Type, configuration.Source.Image)
+	ctx.Config = &configuration
+	ctx.HandleSignals()
 
-	for artifactName, artifact := range configuration.Artifacts {
-		log.DEBUG.Printf("Artifact: %s \n", artifactName)
-		for recipeName, recipe := range artifact.Recipe {
-			log.DEBUG.Printf("Signaling -> Recipe %s <- to bus\n", recipeName)
-			bus.Publish("artemide:artifact:recipe:" + recipeName)
-			for eventsName, event := range recipe {
-				log.DEBUG.Printf("Signaling -> Event %s : (%s.%s)\n", eventsName, event.Name, event.Action)
-				//bus.Publish("artemide:artifact:recipe:"+recipeName+":event:"+event.Name, event.Action)
-			}
+	builder := build.New(bus, ctx)
+	if workDir != "" {
+		builder.WorkDir = workDir
+	}
+	if err := builder.Run(); err != nil {
+		log.ERROR.Println("Build failed:", err)
+		for _, e := range ctx.Errors() {
+			log.ERROR.Println(" -", e)
 		}
+		os.Exit(1)
 	}
-	//bus.Publish("artemide:recipe:type", recipe_type)
-
+	log.INFO.Println("Build completed")
 }
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/spf13/jwalterweatherman"
+
+	"github.com/mudler/artemide/pkg/cache"
+	config "github.com/mudler/artemide/pkg/config"
+	"github.com/mudler/artemide/pkg/units"
+)
+
+const cacheUsage = `usage: %[1]s cache ls [--dir dir | -c config.toml [-D name=value]]
+       %[1]s cache prune [--older-than 168h] [--max-size 20G] [--dir dir | -c config.toml [-D name=value]]
+the cache is the [cache] dir of the configuration, unless --dir is given
+`
+
+// cacheCommand runs the cache mode, it returns the exit status
+func cacheCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, cacheUsage, os.Args[0])
+		return 1
+	}
+
+	flags := flag.NewFlagSet("cache "+args[0], flag.ContinueOnError)
+	dir := flags.String("dir", "", "cache directory (default "+cache.DefaultDir()+")")
+	configurationFile := flags.String("c", "", "configuration whose cache is used")
+	vars := varsFlag{}
+	flags.Var(vars, "D", "variable of the configuration, as name=value")
+	olderThan := flags.Duration("older-than", 0, "remove the entries not used for this long, e.g. 168h")
+	maxSize := flags.String("max-size", "", "evict the least recently used entries past this size, e.g. 20G")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, cacheUsage, os.Args[0])
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args[1:]); err != nil {
+		return 1
+	}
+
+	// The same cache the builds of the configuration use
+	if *dir == "" && *configurationFile != "" {
+		configuration, err := config.LoadConfig(*configurationFile, vars)
+		if err != nil {
+			log.ERROR.Println(err)
+			return 1
+		}
+		*dir = configuration.Cache.Dir
+	}
+	if *dir == "" {
+		*dir = cache.DefaultDir()
+	}
+
+	c, err := cache.Open(*dir, 0)
+	if err != nil {
+		log.ERROR.Println(err)
+		return 1
+	}
+
+	switch args[0] {
+	case "ls":
+		return cacheList(c)
+	case "prune":
+		return cachePrune(c, *olderThan, *maxSize)
+	}
+	flags.Usage()
+	return 1
+}
+
+func cacheList(c *cache.Cache) int {
+	entries, err := c.List()
+	if err != nil {
+		log.ERROR.Println(err)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "KEY\tIMAGE\tDIGEST\tSIZE\tLAST USED")
+	var total int64
+	for i := len(entries) - 1; i >= 0; i-- {
+		e := entries[i]
+		total += e.Size
+		key := e.Key
+		if len(key) > 12 {
+			key = key[:12]
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", key, e.Image, e.Digest, units.FormatSize(e.Size), e.LastUsed.Format(time.RFC3339))
+	}
+	w.Flush()
+	fmt.Printf("%d entries, %s in %s\n", len(entries), units.FormatSize(total), c.Dir)
+	return 0
+}
+
+func cachePrune(c *cache.Cache, olderThan time.Duration, maxSize string) int {
+	if olderThan == 0 && maxSize == "" {
+		log.ERROR.Println("cache prune wants --older-than, --max-size or both")
+		return 1
+	}
+
+	var removed []*cache.Entry
+	if olderThan > 0 {
+		pruned, err := c.Prune(olderThan)
+		removed = append(removed, pruned...)
+		if err != nil {
+			log.ERROR.Println(err)
+			return 1
+		}
+	}
+	if maxSize != "" {
+		size, err := units.ParseSize(maxSize)
+		if err != nil {
+			log.ERROR.Println(err)
+			return 1
+		}
+		evicted, err := c.Evict(size)
+		removed = append(removed, evicted...)
+		if err != nil {
+			log.ERROR.Println(err)
+			return 1
+		}
+	}
+
+	var freed int64
+	for _, e := range removed {
+		freed += e.Size
+		log.INFO.Println("Removed", e.Image, e.Key)
+	}
+	log.INFO.Printf("%d entries removed, %s freed\n", len(removed), units.FormatSize(freed))
+	return 0
+}
+
+// varsFlag collects the -D name=value flags
+type varsFlag map[string]string
+
+func (v varsFlag) String() string {
+	return ""
+}
+
+func (v varsFlag) Set(value string) error {
+	kv := strings.SplitN(value, "=", 2)
+	if len(kv) != 2 {
+		return fmt.Errorf("-D wants name=value, got %s", value)
+	}
+	v[kv[0]] = kv[1]
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	log "github.com/spf13/jwalterweatherman"
+
+	config "github.com/mudler/artemide/pkg/config"
+	"github.com/mudler/artemide/pkg/dockerutil"
+	"github.com/mudler/artemide/pkg/flatten"
+	"github.com/mudler/artemide/pkg/registry"
+	dockerrecipe "github.com/mudler/artemide/plugin/recipe/docker"
+)
+
+const flattenUsage = `usage: %[1]s flatten <image> -t <newtag> [-o archive.tar [--format docker|oci]] [--registry [--insecure]]
+the image is loaded in the docker daemon, or written to the archive with -o
+`
+
+// flattenCommand runs the flatten mode, it returns the exit status
+func flattenCommand(args []string) int {
+	flags := flag.NewFlagSet("flatten", flag.ContinueOnError)
+	tag := flags.String("t", "", "tag of the flattened image")
+	output := flags.String("o", "", "write the image to this archive instead of loading it")
+	format := flags.String("format", flatten.FormatDocker, "format of the archive, docker or oci")
+	fromRegistry := flags.Bool("registry", false, "pull the image from its registry instead of the docker daemon")
+	insecure := flags.Bool("insecure", false, "plain http to the registry")
+	flags.Usage = func() {
+		fmt.Fprintf(os.Stderr, flattenUsage, os.Args[0])
+		flags.PrintDefaults()
+	}
+
+	// The image may come before the options
+	var image string
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		image, args = args[0], args[1:]
+	}
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if image == "" && flags.NArg() > 0 {
+		image = flags.Arg(0)
+	}
+	if image == "" || *tag == "" {
+		flags.Usage()
+		return 1
+	}
+
+	var src flatten.Source
+	if *fromRegistry {
+		ref, err := registry.ParseReference(image)
+		if err != nil {
+			log.ERROR.Println(err)
+			return 1
+		}
+		client := registry.NewClient()
+		client.PlainHTTP = *insecure
+		if client.Credentials, err = registry.ResolveCredentials(ref.Registry, "", ""); err != nil {
+			log.ERROR.Printf("credentials of %s: %s\n", ref.Registry, err)
+			return 1
+		}
+		src = &flatten.RegistrySource{Client: client, Ref: ref}
+	} else {
+		client, err := dockerutil.NewClient(config.Docker{})
+		if err != nil {
+			log.ERROR.Println("docker is not available:", err)
+			return 1
+		}
+		src = &flatten.DaemonSource{Client: client, Image: image}
+	}
+
+	log.INFO.Printf("Flattening %s into %s\n", image, *tag)
+	if *output != "" {
+		id, err := flatten.WriteFile(src, *output, flatten.Options{Tag: *tag, Format: *format, Comment: "flattened from " + image})
+		if err != nil {
+			log.ERROR.Println(err)
+			return 1
+		}
+		log.INFO.Println("Wrote", *output, "image", id)
+		return 0
+	}
+
+	client, err := dockerrecipe.NewClient(config.Docker{})
+	if err != nil {
+		log.ERROR.Println("docker is not available:", err)
+		return 1
+	}
+	if err := client.Load(src, flatten.Options{Tag: *tag, Comment: "flattened from " + image}); err != nil {
+		log.ERROR.Println(err)
+		return 1
+	}
+	log.INFO.Println("Loaded", *tag)
+	return 0
+}
@@ -41,6 +41,19 @@ func ExtractTar(in io.Reader, dest string) (err error) {
 	})
 }
 
+// Extract extracts the tar on dest, detecting its compression (gzip, bzip2 or xz)
+func Extract(in io.Reader, dest string) error {
+	return archive.Untar(in, dest, &archive.TarOptions{
+		NoLchown:        false,
+		ExcludePatterns: []string{"dev/"}, // prevent operation not permitted
+	})
+}
+
+// Tar streams the content of dir as an uncompressed tar, e.g. to apply it as a layer
+func Tar(dir string) (io.ReadCloser, error) {
+	return archive.TarWithOptions(dir, &archive.TarOptions{Compression: archive.Uncompressed})
+}
+
 func Compress(in io.Reader) io.ReadCloser {
 	pReader, pWriter := io.Pipe()
 	bufWriter := bufio.NewWriterSize(pWriter, compressionBufSize)
@@ -0,0 +1,315 @@
+// Package build drives the artifacts build, emitting the lifecycle phases and the configured recipe events thru the eventbus
+package build
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	evbus "github.com/asaskevich/EventBus"
+	log "github.com/spf13/jwalterweatherman"
+
+	"github.com/mudler/artemide/pkg/checksum"
+	config "github.com/mudler/artemide/pkg/config"
+	"github.com/mudler/artemide/pkg/context"
+	"github.com/mudler/artemide/pkg/osutil"
+	"github.com/mudler/artemide/pkg/phase"
+	"github.com/mudler/artemide/pkg/rootfs"
+	plugin "github.com/mudler/artemide/plugin"
+)
+
+// DefaultWorkDir is where artifacts are built when no other directory is given
+const DefaultWorkDir = "." + string(filepath.Separator) + "artemide_build"
+
+// Builder walks the artifacts of the context configuration and emits their lifecycle phases
+type Builder struct {
+	WorkDir string // each artifact gets its own rootfs under it
+
+	bus     *evbus.EventBus
+	config  *config.Config
+	context *context.Context
+}
+
+// New returns a Builder for the configuration of the context, which must have been validated
+func New(bus *evbus.EventBus, context *context.Context) *Builder {
+	return &Builder{
+		WorkDir: DefaultWorkDir,
+		bus:     bus,
+		config:  context.Config,
+		context: context,
+	}
+}
+
+// Run builds all the artifacts, it returns an error if any of them failed
+func (b *Builder) Run() error {
+	var failed []string
+
+	for _, artifactName := range sortedKeys(b.config.Artifacts) {
+		if b.context.Cancelled() {
+			failed = append(failed, artifactName)
+			continue
+		}
+
+		log.INFO.Printf("Building artifact %s\n", artifactName)
+		if err := b.buildArtifact(artifactName, b.config.Artifacts[artifactName]); err != nil {
+			log.ERROR.Printf("Artifact %s failed: %s\n", artifactName, err)
+			b.context.AddError(fmt.Errorf("%s: %s", artifactName, err))
+			failed = append(failed, artifactName)
+			continue
+		}
+		log.INFO.Printf("Artifact %s built\n", artifactName)
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%d of %d artifacts failed: %v", len(failed), len(b.config.Artifacts), failed)
+	}
+	return nil
+}
+
+// publish signals the event, a panicking handler fails it instead of taking the build down
+func (b *Builder) publish(topic string, ev *plugin.Event) {
+	defer func() {
+		if r := recover(); r != nil {
+			ev.Fail(fmt.Errorf("handler of %s panicked: %v", topic, r))
+		}
+	}()
+	b.bus.Publish(topic, ev)
+}
+
+// cleanup gives the hooks a chance to release what they hold on a failed artifact,
+// then makes sure nothing stays mounted in its rootfs
+func (b *Builder) cleanup(st *artifactState) {
+	log.INFO.Printf("[%s] Cleaning up\n", st.name)
+
+	ev := b.newEvent(st)
+	b.publish(plugin.CleanupTopic, ev)
+	if ev.Failed() {
+		log.ERROR.Printf("[%s] Cleanup failed: %s\n", st.name, ev.Err)
+	}
+
+	if rootfs, err := filepath.Abs(st.dirs.Rootfs); err == nil {
+		if err := osutil.UmountRoot(rootfs); err != nil {
+			log.ERROR.Printf("[%s] Could not unmount %s: %s\n", st.name, rootfs, err)
+		}
+	}
+}
+
+// resetRootfs empties the rootfs of a previous run, the sources unpack in an empty directory.
+// What a crashed run left mounted in it is unmounted first, not to remove the host files.
+func resetRootfs(dir string) error {
+	abs, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	osutil.UmountRoot(abs)
+	mounts, err := osutil.GetMountsByRoot(abs)
+	if err != nil {
+		return err
+	}
+	if len(mounts) > 0 {
+		return fmt.Errorf("%s is still mounted in %s, not removing it", strings.Join(mounts, ", "), dir)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return os.MkdirAll(dir, 0755)
+}
+
+// artifactState is what the driver tracks of an artifact while building it,
+// what the recipes need to know is in the context
+type artifactState struct {
+	name     string
+	artifact config.Artifact
+	dirs     *context.Artifact
+	helpers  *helpers // staged between pre_chroot and post_chroot
+}
+
+func (b *Builder) buildArtifact(artifactName string, artifact config.Artifact) (err error) {
+	st := &artifactState{
+		name:     artifactName,
+		artifact: artifact,
+		dirs:     b.context.Artifact(artifactName),
+	}
+	st.dirs.Rootfs = filepath.Join(b.WorkDir, artifactName, "rootfs")
+	st.dirs.Output = artifact.Destination
+	// Validate refuses such names, the rootfs is removed: never out of the work directory
+	if rel, err := filepath.Rel(b.WorkDir, st.dirs.Rootfs); err != nil || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("artifact %q has its rootfs out of the work directory %s", artifactName, b.WorkDir)
+	}
+	if err := resetRootfs(st.dirs.Rootfs); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(st.dirs.Output, 0755); err != nil {
+		return err
+	}
+
+	// Helpers must never end up in the artifact, whatever happens
+	defer func() {
+		if err != nil {
+			b.cleanup(st)
+		}
+		if st.helpers == nil {
+			return
+		}
+		if herr := st.helpers.remove(); herr != nil && err == nil {
+			err = herr
+		}
+		st.dirs.Helpers = ""
+	}()
+
+	for _, recipeName := range sortedKeys(artifact.Recipe) {
+		log.DEBUG.Printf("Signaling -> Recipe %s <- to bus\n", recipeName)
+		b.bus.Publish("artemide:artifact:recipe:" + recipeName)
+	}
+
+	for _, p := range phase.All {
+		if b.context.Cancelled() {
+			return context.ErrCancelled
+		}
+		b.context.SetPhase(artifactName, p)
+
+		switch p {
+		case phase.AfterUnpack:
+			log.INFO.Printf("[%s] Unpacking %s source %s to %s\n", artifactName, b.config.Source.Type, b.config.Source.Location(), st.dirs.Rootfs)
+			ev := b.newEvent(st)
+			b.publish(plugin.SourceTopic(b.config.Source.Type), ev)
+			if ev.Failed() {
+				return ev.Err
+			}
+			// Whatever the source, the later phases find the rootfs prepared the same way
+			if err := rootfs.Prepare(st.dirs.Rootfs, b.config.Prepare); err != nil {
+				return fmt.Errorf("preparing the rootfs: %s", err)
+			}
+		case phase.AfterPackage:
+			// The rootfs is final, the artifact type packages it before the after_package events
+			if artifact.Type != "" {
+				log.INFO.Printf("[%s] Packaging as %s\n", artifactName, artifact.Type)
+				ev := b.newEvent(st)
+				b.publish(plugin.PackageTopic(artifact.Type), ev)
+				if ev.Failed() {
+					return fmt.Errorf("packaging as %s: %s", artifact.Type, ev.Err)
+				}
+			}
+		case phase.PreChroot:
+			if len(artifact.Helpers) > 0 {
+				if st.helpers, err = stageHelpers(st.dirs.Rootfs, artifact.Helpers, artifact.HelpersMode); err != nil {
+					return err
+				}
+				st.dirs.Helpers = st.helpers.dir
+			}
+		}
+
+		if err := b.emit(st, p); err != nil {
+			return err
+		}
+
+		if p == phase.BeforePackage {
+			if err := rootfs.Finalize(st.dirs.Rootfs, b.config.Prepare); err != nil {
+				return fmt.Errorf("finalizing the rootfs: %s", err)
+			}
+		}
+
+		if p == phase.AfterPackage {
+			if err := checksums(st); err != nil {
+				return err
+			}
+		}
+
+		if p == phase.PostChroot && st.helpers != nil {
+			h := st.helpers
+			st.helpers = nil
+			st.dirs.Helpers = ""
+			if err := h.remove(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// emit signals the phase to the hooks, then to every recipe event bound to it
+func (b *Builder) emit(st *artifactState, p string) error {
+	log.DEBUG.Printf("[%s] Phase %s\n", st.name, p)
+
+	ev := b.newEvent(st)
+	ev.Name = p
+	b.publish(plugin.PhaseTopic(p), ev)
+	if ev.Failed() {
+		return fmt.Errorf("phase %s failed: %s", p, ev.Err)
+	}
+
+	for _, recipeName := range sortedKeys(st.artifact.Recipe) {
+		recipe := st.artifact.Recipe[recipeName]
+		for _, eventID := range sortedKeys(recipe) {
+			event := recipe[eventID]
+			if event.Name != p {
+				continue
+			}
+			ev := b.newEvent(st)
+			ev.Recipe = recipeName
+			ev.ID = eventID
+			ev.Name = event.Name
+			ev.Action = event.Action
+			ev.Config = event
+			if event.Timeout != "" {
+				timeout, err := time.ParseDuration(event.Timeout)
+				if err != nil {
+					return fmt.Errorf("event %s of recipe %s: invalid timeout %q: %s", eventID, recipeName, event.Timeout, err)
+				}
+				ev.Timeout = timeout
+			}
+
+			log.DEBUG.Printf("Signaling -> Event %s : (%s.%s)\n", eventID, event.Name, event.Action)
+			b.publish(plugin.EventTopic(recipeName, event.Name), ev)
+			if ev.Failed() {
+				log.ERROR.Printf("[%s] %s.%s (%s) failed: %s\n", st.name, recipeName, eventID, event.Name, ev.Err)
+				return fmt.Errorf("event %s of recipe %s failed: %s", eventID, recipeName, ev.Err)
+			}
+			log.INFO.Printf("[%s] %s.%s (%s) done\n", st.name, recipeName, eventID, event.Name)
+		}
+	}
+	return nil
+}
+
+// checksums writes the checksum files of every output, before after_checksum is emitted
+func checksums(st *artifactState) error {
+	if len(st.artifact.ChecksumType) == 0 {
+		return nil
+	}
+	outputs := st.dirs.Outputs()
+	if len(outputs) == 0 {
+		log.WARN.Printf("[%s] No output to checksum\n", st.name)
+		return nil
+	}
+	for _, output := range outputs {
+		written, err := checksum.Write(output, st.artifact.ChecksumType)
+		if err != nil {
+			return fmt.Errorf("checksum of %s failed: %s", output, err)
+		}
+		for _, w := range written {
+			log.INFO.Printf("[%s] Wrote %s\n", st.name, w)
+		}
+	}
+	return nil
+}
+
+func (b *Builder) newEvent(st *artifactState) *plugin.Event {
+	return &plugin.Event{
+		Artifact: st.name,
+		Context:  b.context,
+	}
+}
+
+// sortedKeys gives a stable order to the maps decoded from the configuration
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
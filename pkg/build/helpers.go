@@ -0,0 +1,97 @@
+package build
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	log "github.com/spf13/jwalterweatherman"
+
+	"github.com/mudler/artemide/pkg/osutil"
+)
+
+// Helpers modes, how the host paths get in the rootfs
+const (
+	HelpersCopy = "copy"
+	HelpersBind = "bind" // read only bind mount, directories only
+)
+
+// helpers is a temporary directory in the rootfs holding the host paths listed in the artifact
+type helpers struct {
+	rootfs string
+	dir    string // host path of the directory
+	mounts []string
+}
+
+// Path returns where the helpers are seen from inside the chroot
+func (h *helpers) Path() string {
+	rel, _ := filepath.Rel(h.rootfs, h.dir)
+	return "/" + rel
+}
+
+// stageHelpers copies, or bind mounts read only, the paths in a new directory in the rootfs
+func stageHelpers(rootfs string, paths []string, mode string) (*helpers, error) {
+	if mode == "" {
+		mode = HelpersCopy
+	}
+	if mode != HelpersCopy && mode != HelpersBind {
+		return nil, fmt.Errorf("unknown helpers mode %q", mode)
+	}
+
+	rootfs, err := filepath.Abs(rootfs)
+	if err != nil {
+		return nil, err
+	}
+	dir, err := ioutil.TempDir(rootfs, ".artemide-helpers")
+	if err != nil {
+		return nil, err
+	}
+	h := &helpers{rootfs: rootfs, dir: dir}
+
+	for _, p := range paths {
+		src, err := filepath.Abs(p)
+		if err != nil {
+			h.remove()
+			return nil, err
+		}
+		dest := filepath.Join(dir, filepath.Base(src))
+
+		if mode == HelpersBind && osutil.ExistsDir(src) {
+			log.DEBUG.Println("Binding helper", src, "to", dest)
+			if err := osutil.BindMount(src+":"+filepath.Join(h.Path(), filepath.Base(src)), rootfs, true); err != nil {
+				h.remove()
+				return nil, err
+			}
+			h.mounts = append(h.mounts, dest)
+			continue
+		}
+
+		log.DEBUG.Println("Copying helper", src, "to", dest)
+		if err := osutil.RunCmd("cp", "-a", src, dest); err != nil {
+			h.remove()
+			return nil, fmt.Errorf("could not copy helper %s: %s", src, err)
+		}
+	}
+
+	log.INFO.Println("Helpers staged in", dir)
+	return h, nil
+}
+
+// remove unmounts and deletes the helpers. Nothing is deleted while a bind mount is
+// still in place, that would delete the host files.
+func (h *helpers) remove() error {
+	for _, m := range h.mounts {
+		if err := osutil.Unmount(m, syscall.MNT_DETACH); err != nil {
+			return fmt.Errorf("could not unmount helper %s, leaving %s in place: %s", m, h.dir, err)
+		}
+	}
+	h.mounts = nil
+
+	if err := os.RemoveAll(h.dir); err != nil {
+		return fmt.Errorf("could not remove helpers %s: %s", h.dir, err)
+	}
+	log.DEBUG.Println("Helpers removed from", h.dir)
+	return nil
+}
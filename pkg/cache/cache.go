@@ -0,0 +1,302 @@
+// Package cache keeps the root filesystems unpacked by the sources, keyed by the content
+// they come from, so the next builds copy them instead of pulling and extracting again
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/spf13/jwalterweatherman"
+
+	"github.com/mudler/artemide/pkg/image"
+	"github.com/mudler/artemide/pkg/osutil"
+	"github.com/mudler/artemide/pkg/units"
+)
+
+const (
+	entryFile = "entry.json"
+	rootfsDir = "rootfs"
+	tmpPrefix = "tmp-"
+)
+
+// DefaultDir is where the cache lives: $ARTEMIDE_CACHE_DIR, or artemide in the user cache directory
+func DefaultDir() string {
+	if dir := os.Getenv("ARTEMIDE_CACHE_DIR"); dir != "" {
+		return dir
+	}
+	if dir := os.Getenv("XDG_CACHE_HOME"); dir != "" {
+		return filepath.Join(dir, "artemide")
+	}
+	return filepath.Join(os.Getenv("HOME"), ".cache", "artemide")
+}
+
+// Cache is a directory of pristine root filesystems, as unpacked before any customisation
+type Cache struct {
+	Dir     string
+	MaxSize int64 // in bytes, the least recently used entries are evicted past it; 0 is unlimited
+}
+
+// Entry describes a cached rootfs
+type Entry struct {
+	Key      string
+	Image    string // what was unpacked
+	Digest   string // manifest digest, or image id, it was unpacked from
+	Created  time.Time
+	LastUsed time.Time
+	Size     int64
+
+	dir string
+}
+
+// Open returns the cache in dir, creating it if needed
+func Open(dir string, maxSize int64) (*Cache, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &Cache{Dir: dir, MaxSize: maxSize}, nil
+}
+
+// Key identifies the rootfs unpacked from a manifest digest, or image id, and its layers digests
+func Key(digest string, layers []string) string {
+	key := image.FromBytes([]byte(digest + "\n" + strings.Join(layers, "\n")))
+	return strings.TrimPrefix(key, "sha256:")
+}
+
+// Lookup returns the entry of key, if cached
+func (c *Cache) Lookup(key string) (*Entry, bool) {
+	e, err := c.readEntry(filepath.Join(c.Dir, key))
+	if err != nil {
+		return nil, false
+	}
+	return e, true
+}
+
+// Restore copies the cached rootfs of key in dest, reflinking where the filesystem can
+func (c *Cache) Restore(key string, dest string) error {
+	e, ok := c.Lookup(key)
+	if !ok {
+		return fmt.Errorf("%s is not cached", key)
+	}
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	if err := osutil.CopyTree(filepath.Join(e.dir, rootfsDir), dest); err != nil {
+		return err
+	}
+	e.LastUsed = time.Now()
+	return c.writeEntry(e)
+}
+
+// Store copies the rootfs in src to the cache, under key, then evicts past MaxSize
+func (c *Cache) Store(key string, entry Entry, src string) error {
+	final := filepath.Join(c.Dir, key)
+	if _, ok := c.Lookup(key); ok {
+		return nil
+	}
+
+	// Copied aside, then renamed: a failed copy never looks like an entry
+	tmp, err := ioutil.TempDir(c.Dir, tmpPrefix)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmp)
+
+	if err := os.Mkdir(filepath.Join(tmp, rootfsDir), 0755); err != nil {
+		return err
+	}
+	if err := osutil.CopyTree(src, filepath.Join(tmp, rootfsDir)); err != nil {
+		return err
+	}
+
+	entry.Key = key
+	entry.Created = time.Now()
+	entry.LastUsed = entry.Created
+	entry.dir = tmp
+	if entry.Size, err = diskUsage(filepath.Join(tmp, rootfsDir)); err != nil {
+		return err
+	}
+	if err := c.writeEntry(&entry); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, final); err != nil {
+		if _, ok := c.Lookup(key); ok {
+			return nil // stored meanwhile by another build
+		}
+		return err
+	}
+
+	// Never the entry just stored: Unpack restores from it
+	if c.MaxSize > 0 {
+		if entry.Size > c.MaxSize {
+			log.WARN.Printf("%s alone is larger than the cache max_size, %s\n", entry.Image, units.FormatSize(c.MaxSize))
+		}
+		if _, err := c.evict(c.MaxSize, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Unpack restores the rootfs of key in dest, or calls unpack to fill dest and stores the
+// result. Failing to store is only warned about. A nil Cache just unpacks.
+func (c *Cache) Unpack(key string, entry Entry, dest string, unpack func() error) error {
+	if c == nil {
+		return unpack()
+	}
+
+	if _, ok := c.Lookup(key); ok {
+		log.INFO.Println("Restoring", entry.Image, "from the cache", key)
+		err := c.Restore(key, dest)
+		if err == nil {
+			return nil
+		}
+		log.WARN.Println("Could not restore from the cache, unpacking:", err)
+		if err := os.RemoveAll(dest); err != nil {
+			return err
+		}
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			return err
+		}
+	}
+
+	if err := unpack(); err != nil {
+		return err
+	}
+
+	log.INFO.Println("Caching", entry.Image, "as", key)
+	if err := c.Store(key, entry, dest); err != nil {
+		log.WARN.Println("Could not cache", entry.Image+":", err)
+	}
+	return nil
+}
+
+// List returns the entries, least recently used first
+func (c *Cache) List() ([]*Entry, error) {
+	names, err := ioutil.ReadDir(c.Dir)
+	if err != nil {
+		return nil, err
+	}
+	var entries []*Entry
+	for _, fi := range names {
+		if !fi.IsDir() || strings.HasPrefix(fi.Name(), tmpPrefix) {
+			continue
+		}
+		e, err := c.readEntry(filepath.Join(c.Dir, fi.Name()))
+		if err != nil {
+			log.WARN.Println("Skipping", fi.Name(), "in the cache:", err)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	sort.Sort(byLastUsed(entries))
+	return entries, nil
+}
+
+// Remove deletes the entry of key
+func (c *Cache) Remove(key string) error {
+	return os.RemoveAll(filepath.Join(c.Dir, key))
+}
+
+// Prune removes the entries not used since olderThan, returning them
+func (c *Cache) Prune(olderThan time.Duration) ([]*Entry, error) {
+	entries, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+	limit := time.Now().Add(-olderThan)
+	var removed []*Entry
+	for _, e := range entries {
+		if e.LastUsed.After(limit) {
+			continue
+		}
+		if err := c.Remove(e.Key); err != nil {
+			return removed, err
+		}
+		removed = append(removed, e)
+	}
+	return removed, nil
+}
+
+// Evict removes the least recently used entries until the cache fits in maxSize, returning them
+func (c *Cache) Evict(maxSize int64) ([]*Entry, error) {
+	return c.evict(maxSize, "")
+}
+
+// evict is Evict keeping the entry of key, even when it doesn't fit in maxSize alone
+func (c *Cache) evict(maxSize int64, keep string) ([]*Entry, error) {
+	entries, err := c.List()
+	if err != nil {
+		return nil, err
+	}
+	var total int64
+	for _, e := range entries {
+		total += e.Size
+	}
+	var removed []*Entry
+	for _, e := range entries {
+		if total <= maxSize {
+			break
+		}
+		if e.Key == keep {
+			continue
+		}
+		log.INFO.Println("Evicting", e.Image, e.Key, "from the cache")
+		if err := c.Remove(e.Key); err != nil {
+			return removed, err
+		}
+		total -= e.Size
+		removed = append(removed, e)
+	}
+	return removed, nil
+}
+
+func (c *Cache) readEntry(dir string) (*Entry, error) {
+	body, err := ioutil.ReadFile(filepath.Join(dir, entryFile))
+	if err != nil {
+		return nil, err
+	}
+	e := &Entry{}
+	if err := json.Unmarshal(body, e); err != nil {
+		return nil, err
+	}
+	// The directory is the key, whatever entry.json says: Remove must never get an empty one
+	e.Key = filepath.Base(dir)
+	e.dir = dir
+	return e, nil
+}
+
+func (c *Cache) writeEntry(e *Entry) error {
+	body, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(e.dir, entryFile), body, 0644)
+}
+
+type byLastUsed []*Entry
+
+func (b byLastUsed) Len() int           { return len(b) }
+func (b byLastUsed) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
+func (b byLastUsed) Less(i, j int) bool { return b[i].LastUsed.Before(b[j].LastUsed) }
+
+// diskUsage sums the size of the files under dir
+func diskUsage(dir string) (int64, error) {
+	var size int64
+	err := filepath.Walk(dir, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.Mode().IsRegular() {
+			size += fi.Size()
+		}
+		return nil
+	})
+	return size, err
+}
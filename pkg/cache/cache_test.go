@@ -0,0 +1,47 @@
+package cache
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStoreLargerThanMaxSize(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	c, err := Open(filepath.Join(dir, "cache"), 1024)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rootfs := func(name string, size int) string {
+		src := filepath.Join(dir, name)
+		if err := os.MkdirAll(src, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.Join(src, "file"), make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return src
+	}
+
+	if err := c.Store("small", Entry{Image: "small"}, rootfs("small", 512)); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Store("large", Entry{Image: "large"}, rootfs("large", 4096)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := c.Lookup("large"); !ok {
+		t.Error("evicted the entry just stored")
+	}
+	if _, ok := c.Lookup("small"); ok {
+		t.Error("kept an entry past max_size")
+	}
+	if err := c.Restore("large", filepath.Join(dir, "restored")); err != nil {
+		t.Error(err)
+	}
+}
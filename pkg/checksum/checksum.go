@@ -0,0 +1,90 @@
+// Package checksum generates the checksum sidecar files of the artifacts
+package checksum
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+var algorithms = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// Supported returns the checksum types that can be generated
+func Supported() []string {
+	var types []string
+	for t := range algorithms {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	return types
+}
+
+// IsSupported tells if the checksum type can be generated
+func IsSupported(t string) bool {
+	_, ok := algorithms[t]
+	return ok
+}
+
+// Write computes the requested checksums of file in a single pass, and writes each of them
+// in <file>.<type>, in the format expected by md5sum -c, sha256sum -c, etc.
+// It returns the paths of the written files.
+func Write(file string, types []string) ([]string, error) {
+	hashes := map[string]hash.Hash{}
+	var writers []io.Writer
+	for _, t := range types {
+		newHash, ok := algorithms[t]
+		if !ok {
+			return nil, fmt.Errorf("unsupported checksum type %q (expected one of %v)", t, Supported())
+		}
+		if _, done := hashes[t]; done {
+			continue
+		}
+		h := newHash()
+		hashes[t] = h
+		writers = append(writers, h)
+	}
+	if len(writers) == 0 {
+		return nil, nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(io.MultiWriter(writers...), f); err != nil {
+		return nil, fmt.Errorf("could not read %s: %s", file, err)
+	}
+
+	var written []string
+	for _, t := range types {
+		h, ok := hashes[t]
+		if !ok {
+			continue
+		}
+		delete(hashes, t)
+
+		sidecar := file + "." + t
+		line := fmt.Sprintf("%s  %s\n", hex.EncodeToString(h.Sum(nil)), filepath.Base(file))
+		if err := ioutil.WriteFile(sidecar, []byte(line), 0644); err != nil {
+			return written, err
+		}
+		written = append(written, sidecar)
+	}
+	return written, nil
+}
@@ -1,51 +1,279 @@
 package config
 
 import (
+	"fmt"
 	"path/filepath"
+	"strings"
 
 	log "github.com/spf13/jwalterweatherman"
 
 	"github.com/BurntSushi/toml"
+
+	"github.com/mudler/artemide/pkg/image"
 )
 
-type tomlConfig struct {
-	Env          []string
+// Config is the artemide build configuration, as read from the TOML file
+type Config struct {
+	Env          []string            // environment variables imported as ${name}, taking over [vars]
+	Vars         map[string]string   `toml:"vars"`
 	VendorString string              `toml:"vendor"`
-	Source       source              `toml:"source"`
-	Artifacts    map[string]artifact `toml:"artifact"`
+	Source       Source              `toml:"source"`
+	Docker       Docker              `toml:"docker"`
+	Cache        Cache               `toml:"cache"`
+	Prepare      Prepare             `toml:"prepare"`
+	Artifacts    map[string]Artifact `toml:"artifact"`
+
+	file  string
+	meta  toml.MetaData
+	lines map[string]int
+}
+
+// Source describes where the rootfs comes from
+type Source struct {
+	Type     string `toml:"type"`
+	Image    string `toml:"image"`
+	Path     string `toml:"path"`     // local file or directory, for the sources not pulling images
+	Platform string `toml:"platform"` // os/architecture[/variant] picked from multi-platform images, e.g. linux/arm/v7
+	Insecure bool   `toml:"insecure"` // plain http to the registry, for local ones
+
+	// Explicit registry credentials, ~/.docker/config.json is used when unset
+	Username    string `toml:"username"`
+	PasswordEnv string `toml:"password_env"` // environment variable holding the password
 }
 
-type source struct {
-	Type  string `toml:"type"`
-	Image string `toml:"image"`
+// TargetPlatform returns the platform the image must be built for, empty when none was given
+func (s Source) TargetPlatform() (image.Platform, error) {
+	if s.Platform == "" {
+		return image.Platform{}, nil
+	}
+	return image.ParsePlatform(s.Platform)
 }
 
-type event struct {
-	Action string `toml:"action"`
-	Name   string `toml:"name"`
+// Location is what the source unpacks, for the logs: its path if set, its image otherwise
+func (s Source) Location() string {
+	if s.Path != "" {
+		return s.Path
+	}
+	return s.Image
 }
 
-type artifact struct {
-	Destination   string
-	checksum_type []string
-	Recipe        map[string]events
+// Docker is the connection to the docker daemon, DOCKER_HOST, DOCKER_TLS_VERIFY
+// and DOCKER_CERT_PATH are used for what is unset
+type Docker struct {
+	Host      string `toml:"host"`       // e.g. unix:///var/run/docker.sock or tcp://builder:2376
+	TLSVerify *bool  `toml:"tls_verify"` // unset follows DOCKER_TLS_VERIFY, false turns it off
+	CertPath  string `toml:"cert_path"`  // holding ca.pem, cert.pem and key.pem
 }
 
-type events map[string]event
+// Cache configures the cache of the unpacked sources
+type Cache struct {
+	Dir      string `toml:"dir"`      // defaults to $ARTEMIDE_CACHE_DIR, or ~/.cache/artemide
+	MaxSize  string `toml:"max_size"` // e.g. "20G", the least recently used entries are evicted past it
+	Disabled bool   `toml:"disabled"`
+}
 
-func LoadConfig(f string) (tomlConfig, error) {
+// Prepare is how the unpacked rootfs is readied for the build, and cleaned before packaging
+type Prepare struct {
+	ResolvConf          string   `toml:"resolv_conf"`            // host (default), custom or keep
+	Nameservers         []string `toml:"nameservers"`            // written to resolv.conf by the custom policy
+	KeepBuildResolvConf bool     `toml:"keep_build_resolv_conf"` // ship the build resolv.conf instead of restoring the original
+	Hostname            string   `toml:"hostname"`
+	Hosts               []string `toml:"hosts"` // extra /etc/hosts lines, e.g. "10.0.0.1 mirror.lan"
+	ResetMachineID      bool     `toml:"reset_machine_id"`
+	Strip               []string `toml:"strip"` // files removed from the rootfs, .dockerenv and .dockerinit when unset
+}
+
+// Event binds an action to a recipe event
+type Event struct {
+	Action  string `toml:"action"`
+	Name    string `toml:"name"`
+	Timeout string `toml:"timeout"` // e.g. "10m", recipes use their own default when empty
+
+	// Used by the actions running inside_chroot
+	User         string   `toml:"user"`
+	Group        string   `toml:"group"`
+	Binds        []string `toml:"binds"`    // host directories to mount in the rootfs, "src[:dest]"
+	RoBinds      []string `toml:"ro_binds"` // same, read only
+	Capabilities []string `toml:"capabilities"`
+}
+
+// Artifact is an output of the build, the recipes are signaled with their events
+type Artifact struct {
+	Destination  string
+	Type         string   `toml:"type"` // packaging done by a plugin once the hooks are done, e.g. docker-image
+	Image        Image    `toml:"image"`
+	SDCard       SDCard   `toml:"sdcard"`
+	Board        Board    `toml:"board"`         // for the sdcard artifacts of ARM boards
+	ChecksumType []string `toml:"checksum_type"` // md5, sha1, sha256, sha512
+	Recipe       map[string]Events
+
+	// Host paths available to the scripts from pre_chroot to post_chroot
+	Helpers     []string `toml:"helpers"`
+	HelpersMode string   `toml:"helpers_mode"` // "copy" (default) or "bind", read only
+}
+
+// Image is how a docker-image artifact is tagged and shipped
+type Image struct {
+	Tag     string `toml:"tag"`
+	Load    bool   `toml:"load"`    // into the daemon of [docker]
+	Archive string `toml:"archive"` // file written in the destination
+	Format  string `toml:"format"`  // of the archive, docker (default, for docker load) or oci
+
+	Config ImageConfig `toml:"config"` // taking over the configuration of the source image
+}
+
+// The sdcard values when unset, in bytes
+const (
+	DefaultSDCardStart    = 1 << 20
+	DefaultSDCardBootSize = 64 << 20
+)
+
+// SDCard is the disk image of an sdcard artifact: a vfat boot partition filled from a directory
+// of the rootfs, followed by an ext4 root partition with the rest, taking the remaining space
+type SDCard struct {
+	File      string `toml:"file"`       // in the destination, <artifact>.img by default
+	Size      string `toml:"size"`       // of the image, e.g. "4G"
+	Table     string `toml:"table"`      // msdos (default) or gpt
+	Start     string `toml:"start"`      // of the first partition, 1M by default, leaving room for the bootloader
+	BootSize  string `toml:"boot_size"`  // 64M by default, "0" for no boot partition
+	BootDir   string `toml:"boot_dir"`   // rootfs directory copied in the boot partition, /boot by default
+	BootLabel string `toml:"boot_label"` // BOOT by default
+	RootLabel string `toml:"root_label"` // rootfs by default
+}
+
+// Board is what a board needs on its sdcard image besides the rootfs. What is unset comes from
+// the preset, when one is picked. The paths of the blobs and files are in the rootfs.
+type Board struct {
+	Preset      string   `toml:"preset"`       // board the defaults come from, e.g. cubietruck
+	UBoot       string   `toml:"uboot"`        // bootloader blob written raw in the image, before the first partition
+	UBootOffset string   `toml:"uboot_offset"` // where, e.g. "8K"
+	Files       []string `toml:"files"`        // copied to the boot partition, "src[:dest]", src may be a glob and dest is a directory
+	Kernel      string   `toml:"kernel"`       // path in the boot partition, the boot script is generated when set
+	FDT         string   `toml:"fdt"`          // device tree path in the boot partition
+	Cmdline     string   `toml:"cmdline"`      // kernel command line
+	BootScript  string   `toml:"boot_script"`  // template of the boot.cmd compiled to boot.scr, on the host; a generic one when unset
+}
+
+// ImageConfig overrides the runtime configuration of an image, what is unset is kept
+type ImageConfig struct {
+	Entrypoint   []string          `toml:"entrypoint"` // also clears the cmd, unless set too
+	Cmd          []string          `toml:"cmd"`
+	Env          []string          `toml:"env"` // NAME=value, replacing the variable of the same name
+	Volumes      []string          `toml:"volumes"`
+	ExposedPorts []string          `toml:"exposed_ports"` // e.g. "80/tcp", tcp when the protocol is omitted
+	Labels       map[string]string `toml:"labels"`
+	User         string            `toml:"user"`
+	WorkingDir   string            `toml:"working_dir"`
+	StopSignal   string            `toml:"stop_signal"`
+}
+
+// Apply overrides c, the way the same Dockerfile instructions would. The slices and maps
+// of c are copied before they are changed, they may be shared with another configuration.
+func (o ImageConfig) Apply(c *image.ContainerConfig) {
+	c.Env = append([]string(nil), c.Env...)
+	c.Volumes = copySet(c.Volumes)
+	c.ExposedPorts = copySet(c.ExposedPorts)
+	if c.Labels != nil {
+		labels := map[string]string{}
+		for k, v := range c.Labels {
+			labels[k] = v
+		}
+		c.Labels = labels
+	}
+
+	if o.Entrypoint != nil {
+		c.Entrypoint = o.Entrypoint
+		c.Cmd = nil
+	}
+	if o.Cmd != nil {
+		c.Cmd = o.Cmd
+	}
+	for _, kv := range o.Env {
+		name := strings.SplitN(kv, "=", 2)[0]
+		replaced := false
+		for i, e := range c.Env {
+			if strings.SplitN(e, "=", 2)[0] == name {
+				c.Env[i] = kv
+				replaced = true
+			}
+		}
+		if !replaced {
+			c.Env = append(c.Env, kv)
+		}
+	}
+	for _, v := range o.Volumes {
+		if c.Volumes == nil {
+			c.Volumes = map[string]struct{}{}
+		}
+		c.Volumes[v] = struct{}{}
+	}
+	for _, p := range o.ExposedPorts {
+		if c.ExposedPorts == nil {
+			c.ExposedPorts = map[string]struct{}{}
+		}
+		if !strings.Contains(p, "/") {
+			p += "/tcp"
+		}
+		c.ExposedPorts[p] = struct{}{}
+	}
+	for k, v := range o.Labels {
+		if c.Labels == nil {
+			c.Labels = map[string]string{}
+		}
+		c.Labels[k] = v
+	}
+	if o.User != "" {
+		c.User = o.User
+	}
+	if o.WorkingDir != "" {
+		c.WorkingDir = o.WorkingDir
+	}
+	if o.StopSignal != "" {
+		c.StopSignal = o.StopSignal
+	}
+}
+
+func copySet(set map[string]struct{}) map[string]struct{} {
+	if set == nil {
+		return nil
+	}
+	copied := map[string]struct{}{}
+	for k := range set {
+		copied[k] = struct{}{}
+	}
+	return copied
+}
+
+// Events maps event identifiers to their definition
+type Events map[string]Event
+
+// LoadConfig reads and decodes the configuration file, then expands the ${name} variables
+// in its strings. Variables come from [vars] and vendor, from the environment variables
+// listed in env, and from overrides, each taking precedence over the previous.
+func LoadConfig(f string, overrides map[string]string) (Config, error) {
 
 	filename, _ := filepath.Abs(f)
 	var err error
-	var config tomlConfig
-	if _, err = toml.DecodeFile(filename, &config); err != nil {
-		log.ERROR.Fatal(err)
-		return config, err
+	var config Config
+	config.file = f
+	if config.meta, err = toml.DecodeFile(filename, &config); err != nil {
+		return config, fmt.Errorf("%s: %s", f, err)
+	}
+	config.lines = indexLines(filename)
+
+	if err = config.interpolate(overrides); err != nil {
+		return config, fmt.Errorf("%s: %s", f, err)
 	}
 
 	log.INFO.Printf("Vendor: %s\n", config.VendorString)
 	log.INFO.Printf("Source Type: %s\n", config.Source.Type)
 	log.INFO.Printf("Source Image: %s\n", config.Source.Image)
+	if config.Source.Path != "" {
+		log.INFO.Printf("Source Path: %s\n", config.Source.Path)
+	}
+	if config.Source.Platform != "" {
+		log.INFO.Printf("Source Platform: %s\n", config.Source.Platform)
+	}
 
 	for artifactName, artifact := range config.Artifacts {
 		log.INFO.Printf("Artifact: %s \n", artifactName)
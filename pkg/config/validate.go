@@ -0,0 +1,382 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mudler/artemide/pkg/checksum"
+	"github.com/mudler/artemide/pkg/disk"
+	"github.com/mudler/artemide/pkg/phase"
+	"github.com/mudler/artemide/pkg/units"
+)
+
+// Known lists what the running binary can handle. Plugins declare it when they
+// register, so it is handed over by the caller.
+type Known struct {
+	Sources     []string // [source] types
+	PathSources []string // [source] types reading source.path, where source.image is optional
+	Recipes     []string // [artifact.<name>.recipe.<recipe>] names
+	Types       []string // artifact types
+}
+
+// Problem is a single validation failure
+type Problem struct {
+	Key     string // TOML key path, e.g. artifact.sdcard.recipe.script.eventloadcard.name
+	Line    int    // 0 when unknown
+	Message string
+}
+
+// ValidationError holds all the problems found in a configuration
+type ValidationError struct {
+	File     string
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	lines := []string{fmt.Sprintf("%s: %d problem(s) found", e.File, len(e.Problems))}
+	for _, p := range e.Problems {
+		location := e.File
+		if p.Line > 0 {
+			location = fmt.Sprintf("%s:%d", e.File, p.Line)
+		}
+		lines = append(lines, fmt.Sprintf("  %s: %s: %s", location, p.Key, p.Message))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Validate checks the configuration semantics, returning every problem at once as a *ValidationError
+func (c *Config) Validate(known Known) error {
+	v := &validator{config: c}
+
+	for _, k := range c.meta.Undecoded() {
+		v.add(k.String(), "unknown key")
+	}
+
+	switch {
+	case c.Source.Type == "":
+		v.add("source.type", "missing")
+	case !contains(known.Sources, c.Source.Type):
+		v.add("source.type", fmt.Sprintf("unknown source type %q (expected one of %v)", c.Source.Type, known.Sources))
+	}
+	if _, err := c.Source.TargetPlatform(); err != nil {
+		v.add("source.platform", err.Error())
+	}
+	if c.Source.Username != "" && c.Source.PasswordEnv == "" {
+		v.add("source.password_env", "missing, the password of username is read from it")
+	}
+	if c.Source.Username == "" && c.Source.PasswordEnv != "" {
+		v.add("source.username", "missing, password_env is set")
+	}
+	if contains(known.PathSources, c.Source.Type) {
+		if c.Source.Path == "" {
+			v.add("source.path", "missing")
+		} else if _, err := os.Stat(c.Source.Path); err != nil {
+			v.add("source.path", fmt.Sprintf("%s not found", c.Source.Path))
+		}
+	} else if c.Source.Image == "" {
+		v.add("source.image", "missing")
+	}
+
+	if c.Cache.MaxSize != "" {
+		if _, err := units.ParseSize(c.Cache.MaxSize); err != nil {
+			v.add("cache.max_size", err.Error())
+		}
+	}
+
+	v.prepare(c.Prepare)
+
+	for _, name := range sortedKeys(c.Artifacts) {
+		artifact := c.Artifacts[name]
+		key := "artifact." + name
+
+		// It names the work directory of the artifact
+		if name == "" || name == "." || name == ".." || strings.ContainsRune(name, filepath.Separator) {
+			v.add(key, fmt.Sprintf("invalid artifact name %q, it can't be empty, . or .., nor hold a %c", name, filepath.Separator))
+		}
+		if artifact.Destination == "" {
+			v.add(key+".destination", "missing")
+		}
+		for i, t := range artifact.ChecksumType {
+			if !checksum.IsSupported(t) {
+				v.add(fmt.Sprintf("%s.checksum_type[%d]", key, i), fmt.Sprintf("unsupported checksum type %q (expected one of %v)", t, checksum.Supported()))
+			}
+		}
+		if artifact.Type != "" && !contains(known.Types, artifact.Type) {
+			v.add(key+".type", fmt.Sprintf("unknown artifact type %q (expected one of %v)", artifact.Type, known.Types))
+		}
+		if artifact.Type == "docker-image" {
+			v.image(key+".image", artifact.Image)
+		} else if !reflect.DeepEqual(artifact.Image, Image{}) {
+			v.add(key+".image", "only used by the docker-image artifacts")
+		}
+		if artifact.Type == "sdcard" {
+			v.sdcard(key+".sdcard", artifact.SDCard)
+		} else if artifact.SDCard != (SDCard{}) {
+			v.add(key+".sdcard", "only used by the sdcard artifacts")
+		}
+		if artifact.Type == "sdcard" {
+			v.board(key+".board", artifact.Board, artifact.SDCard)
+		} else if !reflect.DeepEqual(artifact.Board, Board{}) {
+			v.add(key+".board", "only used by the sdcard artifacts")
+		}
+		if artifact.HelpersMode != "" && artifact.HelpersMode != "copy" && artifact.HelpersMode != "bind" {
+			v.add(key+".helpers_mode", fmt.Sprintf("unknown mode %q (expected copy or bind)", artifact.HelpersMode))
+		}
+		for i, h := range artifact.Helpers {
+			if _, err := os.Stat(h); err != nil {
+				v.add(fmt.Sprintf("%s.helpers[%d]", key, i), err.Error())
+			}
+		}
+
+		for _, recipeName := range sortedKeys(artifact.Recipe) {
+			recipeKey := key + ".recipe." + recipeName
+			if !contains(known.Recipes, recipeName) {
+				v.add(recipeKey, fmt.Sprintf("unknown recipe %q (expected one of %v)", recipeName, known.Recipes))
+			}
+
+			events := artifact.Recipe[recipeName]
+			for _, eventID := range sortedKeys(events) {
+				v.event(recipeKey+"."+eventID, events[eventID])
+			}
+		}
+	}
+
+	if len(v.problems) > 0 {
+		return &ValidationError{File: c.file, Problems: v.problems}
+	}
+	return nil
+}
+
+type validator struct {
+	config   *Config
+	problems []Problem
+}
+
+func (v *validator) add(key string, message string) {
+	v.problems = append(v.problems, Problem{Key: key, Line: v.config.lineOf(key), Message: message})
+}
+
+func (v *validator) event(key string, event Event) {
+	switch {
+	case event.Name == "":
+		v.add(key+".name", "missing")
+	case !phase.Valid(event.Name):
+		v.add(key+".name", fmt.Sprintf("unknown phase %q (expected one of %v)", event.Name, phase.All))
+	}
+	if event.Action == "" {
+		v.add(key+".action", "missing")
+	}
+	if event.Timeout != "" {
+		if _, err := time.ParseDuration(event.Timeout); err != nil {
+			v.add(key+".timeout", err.Error())
+		}
+	}
+	if event.Name != phase.InsideChroot &&
+		(event.User != "" || event.Group != "" || len(event.Binds) > 0 || len(event.RoBinds) > 0 || len(event.Capabilities) > 0) {
+		v.add(key, "user, group, binds, ro_binds and capabilities only apply to inside_chroot")
+	}
+}
+
+// lineOf finds where a key is defined, its table header when the key itself isn't written
+func (c *Config) lineOf(key string) int {
+	key = strings.Split(key, "[")[0]
+	for ; key != ""; key = parentKey(key) {
+		if line, ok := c.lines[key]; ok {
+			return line
+		}
+	}
+	return 0
+}
+
+func parentKey(key string) string {
+	if i := strings.LastIndex(key, "."); i != -1 {
+		return key[:i]
+	}
+	return ""
+}
+
+// indexLines maps the key paths to the line they are defined at. It only knows about
+// plain tables and keys, which is what artemide configurations are made of.
+func indexLines(filename string) map[string]int {
+	lines := map[string]int{}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		return lines
+	}
+	defer f.Close()
+
+	table := ""
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "["):
+			table = strings.Trim(strings.SplitN(line, "]", 2)[0], "[ ")
+			lines[table] = n
+		case strings.Contains(line, "="):
+			k := strings.Trim(strings.TrimSpace(strings.SplitN(line, "=", 2)[0]), `"`)
+			lines[joinPath(table, k)] = n
+		}
+	}
+	return lines
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	for _, k := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, k.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (v *validator) image(key string, i Image) {
+	if i.Tag == "" {
+		v.add(key+".tag", "missing")
+	}
+	if !i.Load && i.Archive == "" {
+		v.add(key, "the image is neither loaded nor archived, set load, archive or both")
+	}
+	if i.Format != "" && i.Format != "docker" && i.Format != "oci" {
+		v.add(key+".format", fmt.Sprintf("unknown format %q (expected docker or oci)", i.Format))
+	}
+	if i.Archive != "" && (filepath.IsAbs(i.Archive) || strings.Contains(i.Archive, "..")) {
+		v.add(key+".archive", "must be a file name in the destination")
+	}
+
+	for n, kv := range i.Config.Env {
+		if !strings.Contains(kv, "=") || strings.HasPrefix(kv, "=") {
+			v.add(fmt.Sprintf("%s.config.env[%d]", key, n), fmt.Sprintf("%q is not NAME=value", kv))
+		}
+	}
+	for n, vol := range i.Config.Volumes {
+		if !filepath.IsAbs(vol) {
+			v.add(fmt.Sprintf("%s.config.volumes[%d]", key, n), fmt.Sprintf("%q is not an absolute path", vol))
+		}
+	}
+	for n, p := range i.Config.ExposedPorts {
+		parts := strings.SplitN(p, "/", 2)
+		port, err := strconv.Atoi(parts[0])
+		if err != nil || port < 1 || port > 65535 || (len(parts) == 2 && !contains([]string{"tcp", "udp", "sctp"}, parts[1])) {
+			v.add(fmt.Sprintf("%s.config.exposed_ports[%d]", key, n), fmt.Sprintf("%q is not a port, optionally followed by /tcp, /udp or /sctp", p))
+		}
+	}
+}
+
+func (v *validator) sdcard(key string, s SDCard) {
+	// The layout the recipe makes, from the same defaults
+	sizes := map[string]int64{"start": DefaultSDCardStart, "boot_size": DefaultSDCardBootSize}
+	valid := true
+	for _, size := range []struct{ name, value string }{{"size", s.Size}, {"start", s.Start}, {"boot_size", s.BootSize}} {
+		if size.value == "" {
+			continue
+		}
+		n, err := units.ParseSize(size.value)
+		if err != nil {
+			v.add(key+"."+size.name, err.Error())
+			valid = false
+		}
+		sizes[size.name] = n
+	}
+	table := s.Table
+	if table == "" {
+		table = disk.MBR
+	}
+	if table != disk.MBR && table != disk.GPT {
+		v.add(key+".table", fmt.Sprintf("unknown partition table %q (expected %s or %s)", s.Table, disk.MBR, disk.GPT))
+		valid = false
+	}
+	if s.Size == "" {
+		v.add(key+".size", "missing")
+	} else if valid {
+		if _, err := disk.Layout(table, sizes["size"], sizes["start"], sizes["boot_size"]); err != nil {
+			v.add(key, err.Error())
+		}
+	}
+	if len(s.BootLabel) > 11 {
+		v.add(key+".boot_label", "vfat labels are 11 characters at most")
+	}
+	if len(s.RootLabel) > 16 {
+		v.add(key+".root_label", "ext4 labels are 16 characters at most")
+	}
+	if s.File != "" && (filepath.IsAbs(s.File) || strings.Contains(s.File, "..")) {
+		v.add(key+".file", "must be a file name in the destination")
+	}
+}
+
+func (v *validator) board(key string, b Board, s SDCard) {
+	if b.UBootOffset != "" {
+		if _, err := units.ParseSize(b.UBootOffset); err != nil {
+			v.add(key+".uboot_offset", err.Error())
+		}
+		if b.UBoot == "" && b.Preset == "" {
+			v.add(key+".uboot", "missing, uboot_offset is set")
+		}
+	}
+	if b.UBoot != "" && b.UBootOffset == "" && b.Preset == "" {
+		v.add(key+".uboot_offset", "missing, uboot is set")
+	}
+	for i, f := range b.Files {
+		if strings.TrimSpace(strings.SplitN(f, ":", 2)[0]) == "" {
+			v.add(fmt.Sprintf("%s.files[%d]", key, i), fmt.Sprintf("%q is not src[:dest]", f))
+		}
+	}
+	if b.BootScript != "" {
+		if _, err := os.Stat(b.BootScript); err != nil {
+			v.add(key+".boot_script", fmt.Sprintf("%s not found", b.BootScript))
+		}
+	}
+	if s.BootSize != "" {
+		if size, err := units.ParseSize(s.BootSize); err == nil && size == 0 && (len(b.Files) > 0 || b.Kernel != "" || b.BootScript != "") {
+			v.add(key, "files, kernel and boot_script need the boot partition, sdcard.boot_size is 0")
+		}
+	}
+}
+
+func (v *validator) prepare(p Prepare) {
+	switch p.ResolvConf {
+	case "", "host", "keep":
+		if len(p.Nameservers) > 0 {
+			v.add("prepare.nameservers", "only used by the custom resolv_conf policy")
+		}
+	case "custom":
+		if len(p.Nameservers) == 0 {
+			v.add("prepare.nameservers", "missing, needed by the custom resolv_conf policy")
+		}
+	default:
+		v.add("prepare.resolv_conf", fmt.Sprintf("unknown policy %q (expected host, custom or keep)", p.ResolvConf))
+	}
+	for i, ns := range p.Nameservers {
+		if net.ParseIP(ns) == nil {
+			v.add(fmt.Sprintf("prepare.nameservers[%d]", i), fmt.Sprintf("%q is not an IP address", ns))
+		}
+	}
+	for i, line := range p.Hosts {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+			v.add(fmt.Sprintf("prepare.hosts[%d]", i), fmt.Sprintf("%q is not an address followed by names", line))
+		}
+	}
+	if strings.ContainsAny(p.Hostname, " \t/") {
+		v.add("prepare.hostname", fmt.Sprintf("invalid hostname %q", p.Hostname))
+	}
+}
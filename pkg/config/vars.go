@@ -0,0 +1,168 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// maxExpansionDepth bounds variables referencing each other, a cycle would never end
+const maxExpansionDepth = 16
+
+// resolveVars collects the variables usable in ${name} interpolation, by increasing precedence:
+// the [vars] table and vendor, the environment variables listed in env, then the overrides
+// (given on the command line).
+func (c *Config) resolveVars(overrides map[string]string) map[string]string {
+	vars := map[string]string{}
+	for k, v := range c.Vars {
+		vars[k] = v
+	}
+	if c.VendorString != "" {
+		vars["vendor"] = c.VendorString
+	}
+
+	for _, name := range c.Env {
+		if v, ok := os.LookupEnv(name); ok {
+			vars[name] = v
+		} else if v, ok := os.LookupEnv(strings.ToUpper(name)); ok {
+			vars[name] = v
+		}
+	}
+
+	for k, v := range overrides {
+		vars[k] = v
+	}
+	return vars
+}
+
+// interpolate expands the variables in every string of the configuration
+func (c *Config) interpolate(overrides map[string]string) error {
+	vars := c.resolveVars(overrides)
+
+	var errs []string
+	resolved := map[string]string{}
+	for _, k := range sortedVarNames(vars) {
+		v, err := expand(vars[k], vars, 0)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("vars.%s: %s", k, err))
+			continue
+		}
+		resolved[k] = v
+	}
+	c.Vars = resolved
+	c.VendorString = resolved["vendor"]
+
+	interpolateValue(reflect.ValueOf(c).Elem(), "", vars, &errs)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("interpolation failed:\n  %s", strings.Join(errs, "\n  "))
+	}
+	return nil
+}
+
+func interpolateValue(v reflect.Value, path string, vars map[string]string, errs *[]string) {
+	switch v.Kind() {
+	case reflect.String:
+		s, err := expand(v.String(), vars, 0)
+		if err != nil {
+			*errs = append(*errs, fmt.Sprintf("%s: %s", path, err))
+			return
+		}
+		v.SetString(s)
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			// unexported fields, and the variables themselves, are left alone: the vendor is
+			// one of them, already expanded, a second pass would eat the $ its $$ left
+			if f.PkgPath != "" || f.Name == "Vars" || f.Name == "Env" || f.Name == "VendorString" {
+				continue
+			}
+			interpolateValue(v.Field(i), joinPath(path, keyName(f)), vars, errs)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			interpolateValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i), vars, errs)
+		}
+	case reflect.Map:
+		// map values aren't addressable, they are expanded on a copy and stored back
+		for _, k := range v.MapKeys() {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			elem.Set(v.MapIndex(k))
+			interpolateValue(elem, joinPath(path, k.String()), vars, errs)
+			v.SetMapIndex(k, elem)
+		}
+	case reflect.Ptr:
+		if !v.IsNil() {
+			interpolateValue(v.Elem(), path, vars, errs)
+		}
+	}
+}
+
+// expand replaces ${name} with the variable value, $$ is a literal $
+func expand(s string, vars map[string]string, depth int) (string, error) {
+	if !strings.Contains(s, "$") {
+		return s, nil
+	}
+	if depth > maxExpansionDepth {
+		return "", fmt.Errorf("variables nested too deep in %q, is there a cycle?", s)
+	}
+
+	var out []byte
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			out = append(out, s[i])
+			continue
+		}
+		switch s[i+1] {
+		case '$':
+			out = append(out, '$')
+			i++
+		case '{':
+			end := strings.IndexByte(s[i:], '}')
+			if end == -1 {
+				return "", fmt.Errorf("unterminated variable in %q", s)
+			}
+			name := s[i+2 : i+end]
+			value, ok := vars[name]
+			if !ok {
+				return "", fmt.Errorf("undefined variable %q", name)
+			}
+			value, err := expand(value, vars, depth+1)
+			if err != nil {
+				return "", err
+			}
+			out = append(out, value...)
+			i += end
+		default:
+			out = append(out, s[i])
+		}
+	}
+	return string(out), nil
+}
+
+// keyName is the TOML key of a field
+func keyName(f reflect.StructField) string {
+	if tag := f.Tag.Get("toml"); tag != "" {
+		return strings.Split(tag, ",")[0]
+	}
+	return strings.ToLower(f.Name)
+}
+
+func joinPath(path string, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
+
+func sortedVarNames(vars map[string]string) []string {
+	var names []string
+	for k := range vars {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
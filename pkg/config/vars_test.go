@@ -0,0 +1,20 @@
+package config
+
+import "testing"
+
+func TestInterpolateVendor(t *testing.T) {
+	c := &Config{
+		VendorString: "acme $${literal} ${who}",
+		Vars:         map[string]string{"who": "builds"},
+		Source:       Source{Image: "${vendor}"},
+	}
+	if err := c.interpolate(nil); err != nil {
+		t.Fatal(err)
+	}
+	if want := "acme ${literal} builds"; c.VendorString != want {
+		t.Errorf("vendor is %q, want %q", c.VendorString, want)
+	}
+	if want := "acme ${literal} builds"; c.Source.Image != want {
+		t.Errorf("source.image is %q, want %q", c.Source.Image, want)
+	}
+}
@@ -1,7 +1,187 @@
 package context
 
+import (
+	"errors"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	log "github.com/spf13/jwalterweatherman"
+
+	config "github.com/mudler/artemide/pkg/config"
+)
+
+// ErrCancelled is reported when the build is interrupted
+var ErrCancelled = errors.New("build cancelled")
+
 // Context will be our build context, passed over with events. This will enable to share a global status of the building state
 type Context struct {
-	Done  bool
-	State []string
+	Config *config.Config
+
+	mu        sync.Mutex
+	artifacts map[string]*Artifact
+	phase     string
+	store     map[string]interface{}
+	errors    []error
+	done      chan struct{}
+	cancelled bool
+}
+
+// Artifact is the state of an artifact being built
+type Artifact struct {
+	Name    string
+	Rootfs  string // where the source is unpacked and customised
+	Output  string // where the artifact files are written
+	Helpers string // helpers directory in the rootfs, set from pre_chroot to post_chroot
+	Phase   string // last phase emitted for the artifact
+
+	mu      sync.Mutex
+	outputs []string
+}
+
+// New returns an empty build context, the configuration is set once loaded
+func New() *Context {
+	return &Context{
+		artifacts: map[string]*Artifact{},
+		store:     map[string]interface{}{},
+		done:      make(chan struct{}),
+	}
+}
+
+// Artifact returns the state of the named artifact, creating it on first use
+func (c *Context) Artifact(name string) *Artifact {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	a, ok := c.artifacts[name]
+	if !ok {
+		a = &Artifact{Name: name}
+		c.artifacts[name] = a
+	}
+	return a
+}
+
+// SetPhase records the phase being emitted for the artifact
+func (c *Context) SetPhase(artifact string, phase string) {
+	a := c.Artifact(artifact)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.phase = phase
+	a.Phase = phase
+}
+
+// Phase returns the last emitted phase, of whatever artifact
+func (c *Context) Phase() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.phase
+}
+
+// AddOutput records a file produced for the artifact, outputs are checksummed after after_package
+func (a *Artifact) AddOutput(path string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.outputs = append(a.outputs, path)
+}
+
+// Outputs returns the files produced for the artifact
+func (a *Artifact) Outputs() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]string{}, a.outputs...)
+}
+
+// Set stores a value for the other plugins, keys are namespaced by convention (e.g. "docker.image.id")
+func (c *Context) Set(key string, value interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.store[key] = value
+}
+
+// Get returns a stored value
+func (c *Context) Get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	v, ok := c.store[key]
+	return v, ok
+}
+
+// GetString returns a stored string, false if missing or of another type
+func (c *Context) GetString(key string) (string, bool) {
+	v, _ := c.Get(key)
+	s, ok := v.(string)
+	return s, ok
+}
+
+// GetStrings returns a stored string slice, false if missing or of another type
+func (c *Context) GetStrings(key string) ([]string, bool) {
+	v, _ := c.Get(key)
+	s, ok := v.([]string)
+	return s, ok
+}
+
+// GetInt returns a stored int, false if missing or of another type
+func (c *Context) GetInt(key string) (int, bool) {
+	v, _ := c.Get(key)
+	i, ok := v.(int)
+	return i, ok
+}
+
+// GetBool returns a stored bool, false if missing or of another type
+func (c *Context) GetBool(key string) (bool, bool) {
+	v, _ := c.Get(key)
+	b, ok := v.(bool)
+	return b, ok
+}
+
+// AddError accumulates an error of the build
+func (c *Context) AddError(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.errors = append(c.errors, err)
+}
+
+// Errors returns the errors accumulated so far
+func (c *Context) Errors() []error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]error{}, c.errors...)
+}
+
+// Cancel interrupts the build, long running actions should watch Done
+func (c *Context) Cancel() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.cancelled {
+		c.cancelled = true
+		close(c.done)
+	}
+}
+
+// Done is closed when the build is cancelled
+func (c *Context) Done() <-chan struct{} {
+	return c.done
+}
+
+// Cancelled tells if the build was interrupted
+func (c *Context) Cancelled() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.cancelled
+}
+
+// HandleSignals cancels the build on SIGINT and SIGTERM, so it can clean up before exiting
+func (c *Context) HandleSignals() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.WARN.Println("Received", sig, "- cancelling the build")
+			c.Cancel()
+		case <-c.done:
+		}
+		signal.Stop(signals)
+	}()
 }
@@ -0,0 +1,127 @@
+package disk
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	log "github.com/spf13/jwalterweatherman"
+)
+
+// MakeVfat creates at path a vfat filesystem of size bytes, holding the content of dir.
+// mkfs.vfat picks the FAT size from the filesystem size, the partition kind returned is
+// the one of the FAT it made.
+func MakeVfat(path string, size int64, label string, dir string) (Kind, error) {
+	os.Remove(path) // mkfs.vfat -C wants to create the file
+	args := []string{"-C"}
+	if label != "" {
+		args = append(args, "-n", label)
+	}
+	if err := run("mkfs.vfat", append(args, path, strconv.FormatInt(size/1024, 10))...); err != nil {
+		return FAT, err
+	}
+	kind, err := vfatKind(path)
+	if err != nil {
+		return kind, err
+	}
+
+	names, err := readDirNames(dir)
+	if err != nil || len(names) == 0 {
+		return kind, err
+	}
+	args = []string{"-i", path, "-s", "-p", "-m", "-Q"}
+	for _, name := range names {
+		args = append(args, filepath.Join(dir, name))
+	}
+	return kind, run("mcopy", append(args, "::/")...)
+}
+
+// vfatKind reads the FAT size in the boot sector of the vfat filesystem at path. The type
+// string is only informative, but mkfs.vfat always writes it.
+func vfatKind(path string) (Kind, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return FAT, err
+	}
+	defer f.Close()
+	sector := make([]byte, SectorSize)
+	if _, err := io.ReadFull(f, sector); err != nil {
+		return FAT, err
+	}
+	// FAT32 has its extended boot record after the FAT32 fields, FAT12 and FAT16 right after the BPB
+	switch {
+	case string(sector[82:90]) == "FAT32   ":
+		return FAT, nil
+	case string(sector[54:62]) == "FAT16   ":
+		return FAT16, nil
+	case string(sector[54:62]) == "FAT12   ":
+		return FAT12, nil
+	}
+	return FAT, fmt.Errorf("%s: no FAT type in the boot sector", path)
+}
+
+// MakeExt4 creates at path an ext4 filesystem of size bytes, holding the content of dir.
+// The files keep their owners, the root directory is owned by root.
+func MakeExt4(path string, size int64, label string, dir string) error {
+	os.Remove(path)
+	args := []string{"-q", "-F", "-t", "ext4", "-E", "root_owner=0:0", "-d", dir}
+	if label != "" {
+		args = append(args, "-L", label)
+	}
+	return run("mke2fs", append(args, path, strconv.FormatInt(size/1024, 10)+"k")...)
+}
+
+// CopyAt writes the content of the file at src in dst from offset. The blocks of zeroes are
+// skipped, so a sparse dst stays sparse.
+func CopyAt(dst *os.File, offset int64, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	buf := make([]byte, 1<<20)
+	zero := make([]byte, len(buf))
+	for {
+		n, err := io.ReadFull(in, buf)
+		if n > 0 && !bytes.Equal(buf[:n], zero[:n]) {
+			if _, werr := dst.WriteAt(buf[:n], offset); werr != nil {
+				return werr
+			}
+		}
+		offset += int64(n)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func readDirNames(dir string) ([]string, error) {
+	f, err := os.Open(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
+
+// run executes a mkfs tool, its output is in the error when it fails
+func run(name string, arg ...string) error {
+	log.DEBUG.Println("runcmd: ", name, arg)
+	out, err := exec.Command(name, arg...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s: %s", name, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,49 @@
+package disk
+
+import (
+	"fmt"
+
+	"github.com/mudler/artemide/pkg/units"
+)
+
+// rootAlignment is where the root partition starts, a multiple of it
+const rootAlignment = 1 << 20
+
+// Layout lays out, on a disk of size bytes, the boot partition from start when bootSize isn't 0,
+// and the root partition taking the rest
+func Layout(table string, size int64, start int64, bootSize int64) ([]Partition, error) {
+	first, reserved := Reserved(table)
+	if start < first {
+		return nil, fmt.Errorf("the first partition starts at %d, before the end of the %s table at %d", start, table, first)
+	}
+
+	var parts []Partition
+	start = alignUp(start, SectorSize)
+	if bootSize > 0 {
+		boot := Partition{
+			Start:    start,
+			Size:     alignUp(bootSize, SectorSize),
+			Kind:     FAT,
+			Name:     "boot",
+			Bootable: true,
+		}
+		parts = append(parts, boot)
+		start = alignUp(boot.Start+boot.Size, rootAlignment)
+	}
+
+	end := (size - reserved) / SectorSize * SectorSize
+	if end <= start {
+		return nil, fmt.Errorf("an image of %s leaves no room for the root partition", units.FormatSize(size))
+	}
+	return append(parts, Partition{
+		Start:    start,
+		Size:     end - start,
+		Kind:     Linux,
+		Name:     "root",
+		Bootable: bootSize == 0,
+	}), nil
+}
+
+func alignUp(n int64, to int64) int64 {
+	return (n + to - 1) / to * to
+}
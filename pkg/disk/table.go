@@ -0,0 +1,242 @@
+// Package disk writes raw disk images: their partition table, and the filesystems
+// of the partitions, made by the mkfs tools in files so neither loop devices nor root
+// are needed.
+package disk
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"strings"
+	"unicode/utf16"
+)
+
+// SectorSize is the logical sector size of the images
+const SectorSize = 512
+
+// The partition tables
+const (
+	MBR = "msdos"
+	GPT = "gpt"
+)
+
+// Kind is what a partition holds, it gives its type in the table
+type Kind int
+
+// The kinds of partitions
+const (
+	FAT   Kind = iota // vfat with a 32 bits FAT, boot partitions
+	FAT16             // vfat too small for a FAT32
+	FAT12
+	Linux // linux filesystems
+)
+
+var mbrTypes = map[Kind]byte{
+	FAT:   0x0c, // FAT32 with LBA
+	FAT16: 0x0e, // FAT16 with LBA
+	FAT12: 0x01,
+	Linux: 0x83,
+}
+
+var gptTypes = map[Kind]string{
+	FAT:   "EBD0A0A2-B9E5-4433-87C0-68B6B72699C7", // basic data, what the bootloaders read
+	FAT16: "EBD0A0A2-B9E5-4433-87C0-68B6B72699C7",
+	FAT12: "EBD0A0A2-B9E5-4433-87C0-68B6B72699C7",
+	Linux: "0FC63DAF-8483-4772-8E79-3D69D8477DE4",
+}
+
+// Partition is an entry of the table, offsets and sizes are in bytes and sector aligned
+type Partition struct {
+	Start    int64
+	Size     int64
+	Kind     Kind
+	Name     string // GPT only
+	Bootable bool   // the active flag of MBR, the legacy BIOS bootable attribute of GPT
+}
+
+const (
+	gptEntries   = 128
+	gptEntrySize = 128
+	// sectors of the entries array, each copy
+	gptEntriesSectors = gptEntries * gptEntrySize / SectorSize
+)
+
+// Reserved returns how many bytes the table needs at the start and at the end of the disk,
+// the partitions must be out of them
+func Reserved(table string) (start int64, end int64) {
+	if table == GPT {
+		return (2 + gptEntriesSectors) * SectorSize, (1 + gptEntriesSectors) * SectorSize
+	}
+	return SectorSize, 0
+}
+
+// WriteTable writes the partition table of a disk of size bytes in f
+func WriteTable(f *os.File, table string, size int64, parts []Partition) error {
+	if size%SectorSize != 0 {
+		return fmt.Errorf("the disk size %d is not a multiple of %d", size, SectorSize)
+	}
+	first, last := Reserved(table)
+	last = size - last
+	for i, p := range parts {
+		if p.Start%SectorSize != 0 || p.Size%SectorSize != 0 || p.Size <= 0 {
+			return fmt.Errorf("partition %d is not sector aligned", i+1)
+		}
+		if p.Start < first || p.Start+p.Size > last {
+			return fmt.Errorf("partition %d does not fit in the disk, between %d and %d", i+1, first, last)
+		}
+		if i > 0 && p.Start < parts[i-1].Start+parts[i-1].Size {
+			return fmt.Errorf("partition %d overlaps partition %d", i+1, i)
+		}
+	}
+
+	switch table {
+	case MBR:
+		return writeMBR(f, parts)
+	case GPT:
+		return writeGPT(f, size, parts)
+	}
+	return fmt.Errorf("unknown partition table %q (expected %s or %s)", table, MBR, GPT)
+}
+
+func writeMBR(f *os.File, parts []Partition) error {
+	if len(parts) > 4 {
+		return fmt.Errorf("%d partitions, an MBR holds 4", len(parts))
+	}
+	mbr := make([]byte, SectorSize)
+	if _, err := rand.Read(mbr[440:444]); err != nil { // disk signature
+		return err
+	}
+	for i, p := range parts {
+		start, sectors := p.Start/SectorSize, p.Size/SectorSize
+		if start+sectors > 0xffffffff {
+			return fmt.Errorf("partition %d ends past 2TiB, which needs a GPT", i+1)
+		}
+		e := mbr[446+16*i : 446+16*(i+1)]
+		if p.Bootable {
+			e[0] = 0x80
+		}
+		copy(e[1:4], []byte{0xfe, 0xff, 0xff}) // no CHS addressing, LBA only
+		e[4] = mbrTypes[p.Kind]
+		copy(e[5:8], []byte{0xfe, 0xff, 0xff})
+		binary.LittleEndian.PutUint32(e[8:12], uint32(start))
+		binary.LittleEndian.PutUint32(e[12:16], uint32(sectors))
+	}
+	mbr[510], mbr[511] = 0x55, 0xaa
+	_, err := f.WriteAt(mbr, 0)
+	return err
+}
+
+func writeGPT(f *os.File, size int64, parts []Partition) error {
+	if len(parts) > gptEntries {
+		return fmt.Errorf("%d partitions, a GPT holds %d", len(parts), gptEntries)
+	}
+	sectors := size / SectorSize
+	lastLBA := uint64(sectors - 1)
+
+	// The protective MBR covers the whole disk
+	mbr := make([]byte, SectorSize)
+	e := mbr[446:462]
+	copy(e[1:4], []byte{0x00, 0x02, 0x00})
+	e[4] = 0xee
+	copy(e[5:8], []byte{0xff, 0xff, 0xff})
+	binary.LittleEndian.PutUint32(e[8:12], 1)
+	protected := uint64(sectors - 1)
+	if protected > 0xffffffff {
+		protected = 0xffffffff
+	}
+	binary.LittleEndian.PutUint32(e[12:16], uint32(protected))
+	mbr[510], mbr[511] = 0x55, 0xaa
+	if _, err := f.WriteAt(mbr, 0); err != nil {
+		return err
+	}
+
+	entries := make([]byte, gptEntries*gptEntrySize)
+	for i, p := range parts {
+		e := entries[i*gptEntrySize : (i+1)*gptEntrySize]
+		if err := putGUID(e[0:16], gptTypes[p.Kind]); err != nil {
+			return err
+		}
+		if err := randomGUID(e[16:32]); err != nil {
+			return err
+		}
+		binary.LittleEndian.PutUint64(e[32:40], uint64(p.Start/SectorSize))
+		binary.LittleEndian.PutUint64(e[40:48], uint64((p.Start+p.Size)/SectorSize-1))
+		if p.Bootable {
+			binary.LittleEndian.PutUint64(e[48:56], 1<<2)
+		}
+		name := utf16.Encode([]rune(p.Name))
+		if len(name) > 36 {
+			return fmt.Errorf("partition name %q is too long", p.Name)
+		}
+		for j, c := range name {
+			binary.LittleEndian.PutUint16(e[56+2*j:], c)
+		}
+	}
+	entriesCRC := crc32.ChecksumIEEE(entries)
+
+	diskGUID := make([]byte, 16)
+	if err := randomGUID(diskGUID); err != nil {
+		return err
+	}
+	header := func(current, backup, entriesLBA uint64) []byte {
+		h := make([]byte, SectorSize)
+		copy(h[0:8], "EFI PART")
+		binary.LittleEndian.PutUint32(h[8:12], 0x00010000)
+		binary.LittleEndian.PutUint32(h[12:16], 92)
+		binary.LittleEndian.PutUint64(h[24:32], current)
+		binary.LittleEndian.PutUint64(h[32:40], backup)
+		binary.LittleEndian.PutUint64(h[40:48], 2+gptEntriesSectors)
+		binary.LittleEndian.PutUint64(h[48:56], lastLBA-1-gptEntriesSectors)
+		copy(h[56:72], diskGUID)
+		binary.LittleEndian.PutUint64(h[72:80], entriesLBA)
+		binary.LittleEndian.PutUint32(h[80:84], gptEntries)
+		binary.LittleEndian.PutUint32(h[84:88], gptEntrySize)
+		binary.LittleEndian.PutUint32(h[88:92], entriesCRC)
+		binary.LittleEndian.PutUint32(h[16:20], crc32.ChecksumIEEE(h[:92]))
+		return h
+	}
+
+	backupEntries := lastLBA - gptEntriesSectors
+	writes := []struct {
+		lba  uint64
+		data []byte
+	}{
+		{1, header(1, lastLBA, 2)},
+		{2, entries},
+		{backupEntries, entries},
+		{lastLBA, header(lastLBA, 1, backupEntries)},
+	}
+	for _, w := range writes {
+		if _, err := f.WriteAt(w.data, int64(w.lba)*SectorSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// putGUID encodes a GUID the mixed endian way of the GPT
+func putGUID(b []byte, guid string) error {
+	raw, err := hex.DecodeString(strings.Replace(guid, "-", "", -1))
+	if err != nil || len(raw) != 16 {
+		return fmt.Errorf("invalid GUID %q", guid)
+	}
+	// The first three fields are little endian
+	b[0], b[1], b[2], b[3] = raw[3], raw[2], raw[1], raw[0]
+	b[4], b[5] = raw[5], raw[4]
+	b[6], b[7] = raw[7], raw[6]
+	copy(b[8:16], raw[8:16])
+	return nil
+}
+
+// randomGUID writes a version 4 GUID
+func randomGUID(b []byte) error {
+	if _, err := rand.Read(b[:16]); err != nil {
+		return err
+	}
+	b[7] = b[7]&0x0f | 0x40 // version, in the little endian third field
+	b[8] = b[8]&0x3f | 0x80 // variant
+	return nil
+}
@@ -0,0 +1,113 @@
+// Package dockerutil connects to the docker daemon, the way the docker client does
+package dockerutil
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/fsouza/go-dockerclient"
+	log "github.com/spf13/jwalterweatherman"
+
+	config "github.com/mudler/artemide/pkg/config"
+	"github.com/mudler/artemide/pkg/image"
+)
+
+// DefaultHost is the daemon endpoint when neither the configuration nor DOCKER_HOST set one
+const DefaultHost = "unix:///var/run/docker.sock"
+
+// Endpoint returns the daemon host, whether to verify it with TLS and where the certificates are:
+// the [docker] configuration wins over DOCKER_HOST, DOCKER_TLS_VERIFY and DOCKER_CERT_PATH
+func Endpoint(cfg config.Docker) (host string, tlsVerify bool, certPath string) {
+	host = cfg.Host
+	if host == "" {
+		host = os.Getenv("DOCKER_HOST")
+	}
+	if host == "" {
+		host = DefaultHost
+	}
+
+	if cfg.TLSVerify != nil {
+		tlsVerify = *cfg.TLSVerify
+	} else {
+		tlsVerify = os.Getenv("DOCKER_TLS_VERIFY") != ""
+	}
+
+	certPath = cfg.CertPath
+	if certPath == "" {
+		certPath = os.Getenv("DOCKER_CERT_PATH")
+	}
+	if certPath == "" {
+		certPath = filepath.Join(os.Getenv("HOME"), ".docker")
+	}
+	return host, tlsVerify, certPath
+}
+
+// NewClient connects to the daemon, and pings it: an unreachable daemon is reported here
+// rather than by the first call
+func NewClient(cfg config.Docker) (*docker.Client, error) {
+	host, tlsVerify, certPath := Endpoint(cfg)
+
+	var client *docker.Client
+	var err error
+	if tlsVerify {
+		log.DEBUG.Println("Connecting to", host, "with the certificates in", certPath)
+		client, err = docker.NewTLSClient(host,
+			filepath.Join(certPath, "cert.pem"),
+			filepath.Join(certPath, "key.pem"),
+			filepath.Join(certPath, "ca.pem"))
+	} else {
+		log.DEBUG.Println("Connecting to", host)
+		client, err = docker.NewClient(host)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("docker client for %s: %s", host, err)
+	}
+
+	if err := client.Ping(); err != nil {
+		return nil, fmt.Errorf("docker daemon at %s is unreachable: %s", host, err)
+	}
+	return client, nil
+}
+
+// ImageConfig converts what the daemon reports of an inspected image to its configuration blob,
+// without the layers and the history
+func ImageConfig(inspected *docker.Image) image.Config {
+	created := inspected.Created
+	c := image.Config{
+		Created:      &created,
+		Author:       inspected.Author,
+		Architecture: inspected.Architecture,
+		OS:           inspected.OS,
+	}
+	cfg := inspected.Config
+	if cfg == nil {
+		return c
+	}
+	c.Config = image.ContainerConfig{
+		User:       cfg.User,
+		Env:        cfg.Env,
+		Entrypoint: cfg.Entrypoint,
+		Cmd:        cfg.Cmd,
+		Volumes:    cfg.Volumes,
+		WorkingDir: cfg.WorkingDir,
+		Labels:     cfg.Labels,
+		StopSignal: cfg.StopSignal,
+	}
+	if len(cfg.ExposedPorts) > 0 {
+		c.Config.ExposedPorts = map[string]struct{}{}
+		for port := range cfg.ExposedPorts {
+			c.Config.ExposedPorts[string(port)] = struct{}{}
+		}
+	}
+	if h := cfg.Healthcheck; h != nil {
+		c.Config.Healthcheck = &image.HealthConfig{
+			Test:        h.Test,
+			Interval:    h.Interval,
+			Timeout:     h.Timeout,
+			StartPeriod: h.StartPeriod,
+			Retries:     h.Retries,
+		}
+	}
+	return c
+}
@@ -6,11 +6,13 @@ import (
 	"github.com/hashicorp/errwrap"
 )
 
+// Wrapf wraps err in a new error, format must contain {{err}} where err message goes
 func Wrapf(err error, format string) error {
 	return errwrap.Wrapf(format, err)
 }
 
+// Wrapff is Wrapf with the format arguments expanded first
 func Wrapff(err error, format string, v ...interface{}) error {
-	format = fmt.Sprintf(format, v)
+	format = fmt.Sprintf(format, v...)
 	return errwrap.Wrapf(format, err)
 }
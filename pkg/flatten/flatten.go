@@ -1,292 +1,307 @@
+// Package flatten squashes the layers of an image in a single one, and writes the result
+// as an archive docker load or the OCI tools read.
 package flatten
 
 import (
+	"archive/tar"
+	"compress/gzip"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"net"
-	"net/http"
-	"net/http/httputil"
 	"os"
-	"os/exec"
-	"path"
-	"path/filepath"
 	"strings"
-	"text/template"
-)
-
-const DOCKER_PATH = "/var/lib/docker/graph"
-const WHITEOUT = ".wh."
-const Dockerfile = `
-FROM {{.Base}}
-MAINTAINER {{.Author}}
-ADD {{.Archive}} /
-{{if .HasPorts}} EXPOSE {{range $index, $port := .Ports}}{{$port}} {{end}} {{end}}
-{{if .HasCmds}} CMD {{range $index, $cmd := .Cmds}}{{$cmd}} {{end}} {{end}}
-`
-
-type finalImage struct {
-	Base               string
-	NewName            string
-	OriginalName       string
-	Archive            string
-	DockerfileCompiled *template.Template
-	Images             []dockerImage
-}
+	"time"
 
-func (img finalImage) Author() string {
-	return img.Images[0].Author
-}
+	"github.com/mudler/artemide/pkg/image"
+	"github.com/mudler/artemide/pkg/layout"
+)
 
-func (img finalImage) Ports() []string {
-	return img.Images[0].Config.PortSpecs
-}
+// The archive formats
+const (
+	FormatDocker = "docker" // docker save, loaded with docker load
+	FormatOCI    = "oci"    // OCI image layout
+)
 
-func (img finalImage) HasPorts() bool {
-	return len(img.Ports()) > 0
-}
+// Options of Flatten
+type Options struct {
+	Tag    string // name of the new image, latest when it has no tag
+	Format string // FormatDocker when empty
 
-func (img finalImage) Cmds() []string {
-	cmds := img.Images[0].Config.Cmd
-	// ignore /bin/sh -c
-	if len(cmds) > 2 {
-		return cmds[2:len(cmds)]
-	}
-	return []string{}
+	Comment string // of the history entry recording the flatten, e.g. what was flattened
 }
 
-func (img finalImage) HasCmds() bool {
-	return len(img.Cmds()) > 0
-}
+// CreatedBy is the history entry of the layer made by Flatten
+const CreatedBy = "artemide flatten"
 
-type dockerHistory struct {
-	Id        string
-	Tags      []string
-	CreatedBy string
-}
+// flatLayer is the single layer of the new image, kept in temporary files
+type flatLayer struct {
+	path   string // uncompressed
+	diffID string
+	size   int64
 
-type dockerImage struct {
-	Id     string `json:"id"`
-	Parent string `json:"parent"`
-	Author string `json:"author"`
-	Config struct {
-		PortSpecs []string
-		Cmd       []string
-	} `json:"config"`
+	gzPath string // gzipped, for the OCI layout only
+	digest string
+	gzSize int64
 }
 
-func (img dockerImage) Path() string {
-	return path.Join("/var/lib/docker/graph", img.Id)
+func (l *flatLayer) remove() {
+	os.Remove(l.path)
+	if l.gzPath != "" {
+		os.Remove(l.gzPath)
+	}
 }
 
-// returns a name that doesnt have invalid seperator
-func normalizeStr(str string) string {
-	return strings.Replace(str, "/", "-", -1)
-}
+// Flatten writes to w an archive of the image of src with its filesystem in one layer,
+// and the configuration of src. The history of src is kept, its entries marked as empty
+// layers, followed by one recording the flatten. It returns the id of the new image, the digest of its
+// configuration.
+func Flatten(src Source, w io.Writer, opts Options) (string, error) {
+	if opts.Format == "" {
+		opts.Format = FormatDocker
+	}
+	if opts.Format != FormatDocker && opts.Format != FormatOCI {
+		return "", fmt.Errorf("unknown image format %q, expected %s or %s", opts.Format, FormatDocker, FormatOCI)
+	}
+	if opts.Tag == "" {
+		return "", fmt.Errorf("the flattened image needs a tag")
+	}
+	tag := withTag(opts.Tag)
 
-func syncData(img finalImage) (string, error) {
-	dir, err := ioutil.TempDir("/tmp", normalizeStr(img.OriginalName))
+	cfg, err := src.Config()
 	if err != nil {
-		return dir, err
-	}
-	// rsync old images first so data is overridden properly
-	for i := len(img.Images) - 1; i >= 0; i-- {
-		image := img.Images[i]
-		err := exec.Command("sudo", "rsync", "-aHSx", "--devices", "--specials",
-			path.Join(image.Path(), "layer"), dir).Run()
-		fmt.Println(path.Join(image.Path(), "layer"))
-		if err != nil {
-			return dir, err
-		}
-	}
-	return dir, nil
-}
-
-func deleteWhiteouts(tmpImageDir string) error {
-	return filepath.Walk(tmpImageDir, func(p string, info os.FileInfo, err error) error {
-		if err != nil && !os.IsNotExist(err) {
-			return err
-		}
-		name := info.Name()
-		parent := filepath.Dir(p)
-		// if start with whiteout
-		if strings.Index(name, WHITEOUT) == 0 {
-			deletedFile := path.Join(parent, name[len(WHITEOUT):len(name)])
-			// remove deleted files
-			if err := os.RemoveAll(deletedFile); err != nil {
-				return err
-			}
-			// remove the whiteout itself
-			if err := os.RemoveAll(p); err != nil {
-				return err
-			}
-		}
-		return nil
-	})
-}
-
-func buildImage(archivePath string, img finalImage) error {
-	archiveName := filepath.Base(archivePath)
-	img.Archive = archiveName
+		return "", err
+	}
 
-	buildDir, err := ioutil.TempDir("/tmp", normalizeStr(img.NewName))
+	l, err := exportLayer(src, opts.Format == FormatOCI)
+	if l != nil {
+		defer l.remove()
+	}
 	if err != nil {
-		return err
+		return "", err
 	}
-	log("prepare a directory to build new image", buildDir)
-	//defer os.RemoveAll(buildDir)
 
-	log("copy archive file over")
-	if err := exec.Command("cp", archivePath, buildDir).Run(); err != nil {
-		return err
+	now := time.Now().UTC()
+	cfg.Created = &now
+	cfg.RootFS = image.RootFS{Type: "layers", DiffIDs: []string{l.diffID}}
+	history := make([]image.History, 0, len(cfg.History)+1)
+	for _, h := range cfg.History {
+		h.EmptyLayer = true
+		history = append(history, h)
 	}
-
-	log("create dockerfile")
-	dockerFile, err := os.Create(path.Join(buildDir, "Dockerfile"))
+	cfg.History = append(history, image.History{Created: &now, CreatedBy: CreatedBy, Comment: opts.Comment})
+	configBody, err := json.Marshal(cfg)
 	if err != nil {
-		return err
-	}
-	if err = img.DockerfileCompiled.Execute(dockerFile, img); err != nil {
-		return err
+		return "", err
 	}
+	id := image.FromBytes(configBody)
 
-	if err := os.Chdir(buildDir); err != nil {
-		return err
-	}
-	log("create new image")
-	if err := exec.Command("docker", "build", "-t", img.NewName, ".").Run(); err != nil {
-		return err
+	if opts.Format == FormatOCI {
+		err = writeOCI(w, tag, configBody, l)
+	} else {
+		err = writeDocker(w, tag, configBody, l)
 	}
-	return nil
+	return id, err
 }
 
-// given an image, return the current history of that image
-func getHistory(image string) ([]dockerHistory, error) {
-	history := []dockerHistory{}
-	res, err := get("images/" + image + "/history")
+// WriteFile flattens src in a new archive file at path, nothing is left there on failure
+func WriteFile(src Source, path string, opts Options) (string, error) {
+	f, err := os.Create(path)
 	if err != nil {
-		return history, err
+		return "", err
 	}
-	body, err := ioutil.ReadAll(res.Body)
-	res.Body.Close()
-	if err != nil {
-		return history, err
+	id, err := Flatten(src, f, opts)
+	if cerr := f.Close(); err == nil {
+		err = cerr
 	}
-	err = json.Unmarshal(body, &history)
 	if err != nil {
-		return history, err
+		os.Remove(path)
 	}
-	return history, nil
+	return id, err
 }
 
-func getDockerImages(histories []dockerHistory) ([]dockerImage, error) {
-	images := []dockerImage{}
-	for _, history := range histories {
-		img, err := inspectImage(history.Id)
-		if err != nil {
-			return images, err
-		}
-		images = append(images, img)
-	}
-	return images, nil
+// withTag appends the latest tag to a name that has none
+func withTag(name string) string {
+	if strings.Contains(name[strings.LastIndex(name, "/")+1:], ":") {
+		return name
+	}
+	return name + ":latest"
 }
 
-func inspectImage(id string) (img dockerImage, err error) {
-	res, err := get("images/" + id + "/json")
+// exportLayer writes the filesystem of src to a temporary file, hashing it on the way
+func exportLayer(src Source, compress bool) (*flatLayer, error) {
+	f, err := ioutil.TempFile("", "artemide-layer")
 	if err != nil {
-		return
-	}
-	body, err := ioutil.ReadAll(res.Body)
-	res.Body.Close()
-	if err != nil {
-		return
+		return nil, err
 	}
-	err = json.Unmarshal(body, &img)
-	return
-}
+	defer f.Close()
+	l := &flatLayer{path: f.Name()}
 
-func Flatten(flTag string, image string) {
-	DockerfileCompiled, err := template.New("dockerfile").Parse(Dockerfile)
-	if err != nil {
-		exit("failed to compile dockerfile template")
+	d := image.NewDigester()
+	counter := &countingWriter{}
+	if err := src.Export(io.MultiWriter(f, d, counter)); err != nil {
+		return l, err
 	}
-	if image == "" {
-		exit("Missing image")
+	l.diffID = d.Digest()
+	l.size = counter.n
+	if !compress {
+		return l, f.Close()
 	}
-	fmt.Printf("===> Flattenning image: %s into tag: %s\n", image, flTag)
 
-	log("get histories of the current image")
-	histories, err := getHistory(image)
-	if err != nil {
-		exit("Failed to get history", image, err)
+	if _, err := f.Seek(0, 0); err != nil {
+		return l, err
 	}
-
-	log("from the history, get list of images that formed the current image")
-	images, err := getDockerImages(histories)
+	gz, err := ioutil.TempFile("", "artemide-layer-gz")
 	if err != nil {
-		exit("Failed to get info")
+		return l, err
 	}
-	baseImageId := histories[len(histories)-1].Id
-	final := finalImage{
-		Base:               baseImageId,
-		NewName:            flTag,
-		OriginalName:       image,
-		DockerfileCompiled: DockerfileCompiled,
-		Images:             images[0 : len(images)-1],
+	defer gz.Close()
+	l.gzPath = gz.Name()
+
+	d = image.NewDigester()
+	counter = &countingWriter{}
+	zw := gzip.NewWriter(io.MultiWriter(gz, d, counter))
+	if _, err := io.Copy(zw, f); err != nil {
+		return l, err
 	}
-
-	fmt.Println("Base id image is " + baseImageId)
-	dataDir, err := syncData(final)
-	if err != nil {
-		exit("Failed to sync layers")
+	if err := zw.Close(); err != nil {
+		return l, err
 	}
-	defer os.RemoveAll(dataDir)
+	l.digest = d.Digest()
+	l.gzSize = counter.n
+	return l, gz.Close()
+}
 
-	log("recursively delete whiteouts and deleted files in", dataDir)
-	deleteWhiteouts(dataDir)
+type countingWriter struct {
+	n int64
+}
 
-	log("prepare archived contents")
-	archivePath := path.Join(dataDir, filepath.Base(dataDir)+".tar.gz")
-	tar(path.Join(dataDir, "layer"), archivePath)
+func (c *countingWriter) Write(p []byte) (int, error) {
+	c.n += int64(len(p))
+	return len(p), nil
+}
 
-	buildImage(archivePath, final)
+// writeDocker writes the archive in the format of docker save
+func writeDocker(w io.Writer, tag string, configBody []byte, l *flatLayer) error {
+	configName := hex(image.FromBytes(configBody)) + ".json"
+	layerName := hex(l.diffID) + "/layer.tar"
+	manifest, err := json.Marshal([]layout.DockerManifest{{
+		Config:   configName,
+		RepoTags: []string{tag},
+		Layers:   []string{layerName},
+	}})
+	if err != nil {
+		return err
+	}
 
-	log("===> Finished")
+	tw := tar.NewWriter(w)
+	if err := addBytes(tw, configName, configBody); err != nil {
+		return err
+	}
+	if err := addFile(tw, layerName, l.path, l.size); err != nil {
+		return err
+	}
+	if err := addBytes(tw, "manifest.json", manifest); err != nil {
+		return err
+	}
+	return tw.Close()
 }
 
-func get(path string) (*http.Response, error) {
-	dial, err := net.Dial("unix", "/var/run/docker.sock")
+// writeOCI writes the archive as an OCI image layout, the tag is the ref name of the manifest
+func writeOCI(w io.Writer, tag string, configBody []byte, l *flatLayer) error {
+	configDigest := image.FromBytes(configBody)
+	manifestBody, err := json.Marshal(image.Manifest{
+		SchemaVersion: 2,
+		MediaType:     image.MediaTypeOCIManifest,
+		Config: image.Descriptor{
+			MediaType: image.MediaTypeOCIConfig,
+			Digest:    configDigest,
+			Size:      int64(len(configBody)),
+		},
+		Layers: []image.Descriptor{{
+			MediaType: image.MediaTypeOCILayerGz,
+			Digest:    l.digest,
+			Size:      l.gzSize,
+		}},
+	})
 	if err != nil {
-		return nil, err
+		return err
 	}
-	clientconn := httputil.NewClientConn(dial, nil)
-	req, err := http.NewRequest("GET", fmt.Sprintf("/v1.19/%s", path), nil)
-	if err != nil {
-		return nil, err
+	var cfg image.Config
+	if err := json.Unmarshal(configBody, &cfg); err != nil {
+		return err
 	}
-	res, err := clientconn.Do(req)
+	platform := cfg.Platform()
+	manifestDigest := image.FromBytes(manifestBody)
+	indexBody, err := json.Marshal(image.Index{
+		SchemaVersion: 2,
+		MediaType:     image.MediaTypeOCIIndex,
+		Manifests: []image.Descriptor{{
+			MediaType:   image.MediaTypeOCIManifest,
+			Digest:      manifestDigest,
+			Size:        int64(len(manifestBody)),
+			Annotations: map[string]string{layout.RefNameAnnotation: tag},
+			Platform:    &platform,
+		}},
+	})
 	if err != nil {
-		// tries an older version of the API server with localhost:4243
-		endpoint := "http://localhost:4243/v1.18/" + path
-		return http.Get(endpoint)
+		return err
 	}
-	return res, err
+
+	tw := tar.NewWriter(w)
+	if err := addBytes(tw, "oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`)); err != nil {
+		return err
+	}
+	if err := addBytes(tw, blobName(configDigest), configBody); err != nil {
+		return err
+	}
+	if err := addFile(tw, blobName(l.digest), l.gzPath, l.gzSize); err != nil {
+		return err
+	}
+	if err := addBytes(tw, blobName(manifestDigest), manifestBody); err != nil {
+		return err
+	}
+	if err := addBytes(tw, "index.json", indexBody); err != nil {
+		return err
+	}
+	return tw.Close()
 }
 
-func exit(args ...interface{}) {
-	fmt.Println(args...)
-	os.Exit(1)
+func hex(digest string) string {
+	return strings.TrimPrefix(digest, "sha256:")
 }
 
-func log(args ...interface{}) {
-	fmt.Println(args...)
+func blobName(digest string) string {
+	return "blobs/sha256/" + hex(digest)
 }
 
-func tar(dir string, archivePath string) error {
-	return exec.Command("tar", "-C", dir, "--numeric-owner", "-czpf",
-		archivePath, ".").Run()
+func addBytes(tw *tar.Writer, name string, body []byte) error {
+	if err := tw.WriteHeader(header(name, int64(len(body)))); err != nil {
+		return err
+	}
+	_, err := tw.Write(body)
+	return err
+}
+
+func addFile(tw *tar.Writer, name string, path string, size int64) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := tw.WriteHeader(header(name, size)); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, f)
+	return err
 }
 
-func toString(b []byte, err error) (string, error) {
-	return string(b), err
+func header(name string, size int64) *tar.Header {
+	return &tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     size,
+		Typeflag: tar.TypeReg,
+		ModTime:  time.Now(),
+	}
 }
@@ -0,0 +1,147 @@
+package flatten
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/fsouza/go-dockerclient"
+
+	"github.com/mudler/artemide/pkg/dockerutil"
+	"github.com/mudler/artemide/pkg/errwrap"
+	"github.com/mudler/artemide/pkg/image"
+	"github.com/mudler/artemide/pkg/layer"
+	"github.com/mudler/artemide/pkg/registry"
+)
+
+// Source is an image to flatten: its configuration, and its filesystem as a tar
+type Source interface {
+	Config() (image.Config, error)
+	Export(w io.Writer) error
+}
+
+// DaemonSource is an image of a docker daemon, its filesystem is exported from a container
+type DaemonSource struct {
+	Client *docker.Client
+	Image  string
+}
+
+// Config inspects the image, its history comes from the daemon too
+func (s *DaemonSource) Config() (image.Config, error) {
+	inspected, err := s.Client.InspectImage(s.Image)
+	if err != nil {
+		return image.Config{}, errwrap.Wrapff(err, "inspecting %s: {{err}}", s.Image)
+	}
+	cfg := dockerutil.ImageConfig(inspected)
+
+	history, err := s.Client.ImageHistory(s.Image)
+	if err != nil {
+		return cfg, errwrap.Wrapff(err, "history of %s: {{err}}", s.Image)
+	}
+	// Newest first
+	for i := len(history) - 1; i >= 0; i-- {
+		created := time.Unix(history[i].Created, 0).UTC()
+		cfg.History = append(cfg.History, image.History{Created: &created, CreatedBy: history[i].CreatedBy})
+	}
+	return cfg, nil
+}
+
+// Export streams the filesystem of a container created from the image, without the
+// files the daemon adds to each container
+func (s *DaemonSource) Export(w io.Writer) error {
+	container, err := s.Client.CreateContainer(docker.CreateContainerOptions{
+		Config: &docker.Config{
+			Image: s.Image,
+			Cmd:   []string{"true"},
+		},
+	})
+	if err != nil {
+		return errwrap.Wrapf(err, "Couldn't create the container: {{err}}")
+	}
+	defer s.Client.RemoveContainer(docker.RemoveContainerOptions{
+		ID:    container.ID,
+		Force: true,
+	})
+
+	reader, writer := io.Pipe()
+	exported := make(chan error, 1)
+	go func() {
+		err := s.Client.ExportContainer(docker.ExportContainerOptions{ID: container.ID, OutputStream: writer})
+		writer.CloseWithError(err)
+		exported <- err
+	}()
+
+	if err := layer.Filter(reader, w, []string{".dockerenv", ".dockerinit"}); err != nil {
+		reader.CloseWithError(err)
+		<-exported
+		return errwrap.Wrapf(err, "Couldn't export the container: {{err}}")
+	}
+	io.Copy(ioutil.Discard, reader)
+	if err := <-exported; err != nil {
+		return errwrap.Wrapf(err, "Couldn't export the container: {{err}}")
+	}
+	return nil
+}
+
+// RegistrySource is an image of a registry, its layers are applied on a temporary directory
+type RegistrySource struct {
+	Client *registry.Client
+	Ref    registry.Reference
+
+	manifest *image.Manifest
+}
+
+func (s *RegistrySource) resolve() (image.Manifest, error) {
+	if s.manifest == nil {
+		manifest, _, err := s.Client.Resolve(s.Ref)
+		if err != nil {
+			return manifest, err
+		}
+		s.manifest = &manifest
+	}
+	return *s.manifest, nil
+}
+
+// Config fetches the configuration blob of the image
+func (s *RegistrySource) Config() (image.Config, error) {
+	manifest, err := s.resolve()
+	if err != nil {
+		return image.Config{}, err
+	}
+	return s.Client.Config(s.Ref, manifest.Config)
+}
+
+// Export applies the layers, then writes the result as a single layer
+func (s *RegistrySource) Export(w io.Writer) error {
+	manifest, err := s.resolve()
+	if err != nil {
+		return err
+	}
+	dir, err := ioutil.TempDir("", "artemide-flatten")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	if err := s.Client.Apply(s.Ref, manifest, dir); err != nil {
+		return err
+	}
+	return layer.Tar(dir, w, nil)
+}
+
+// DirSource is a root filesystem on disk, with the configuration to give it
+type DirSource struct {
+	Dir         string
+	ImageConfig image.Config
+	Exclude     []string // paths relative to Dir left out of the image
+}
+
+// Config returns ImageConfig
+func (s *DirSource) Config() (image.Config, error) {
+	return s.ImageConfig, nil
+}
+
+// Export writes the content of Dir
+func (s *DirSource) Export(w io.Writer) error {
+	return layer.Tar(s.Dir, w, s.Exclude)
+}
@@ -0,0 +1,209 @@
+// Package image holds the docker and OCI image formats shared by the sources and the flattener
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+	"time"
+)
+
+// Media types of the manifests, indexes, configs and layers artemide understands
+const (
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeDockerConfig       = "application/vnd.docker.container.image.v1+json"
+	MediaTypeDockerLayer        = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+
+	MediaTypeOCIManifest = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIIndex    = "application/vnd.oci.image.index.v1+json"
+	MediaTypeOCIConfig   = "application/vnd.oci.image.config.v1+json"
+	MediaTypeOCILayer    = "application/vnd.oci.image.layer.v1.tar"
+	MediaTypeOCILayerGz  = "application/vnd.oci.image.layer.v1.tar+gzip"
+)
+
+// Platform describes what an image runs on
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+// Descriptor points to a content addressed blob
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	URLs        []string          `json:"urls,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *Platform         `json:"platform,omitempty"`
+}
+
+// Manifest is a docker v2 schema 2 or an OCI image manifest
+type Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+}
+
+// LayerDigests returns the digests of the layers, in order
+func (m Manifest) LayerDigests() []string {
+	var digests []string
+	for _, l := range m.Layers {
+		digests = append(digests, l.Digest)
+	}
+	return digests
+}
+
+// Index is a docker manifest list or an OCI image index
+type Index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Manifests     []Descriptor `json:"manifests"`
+}
+
+// IsIndex tells if the media type is a manifest list or an image index
+func IsIndex(mediaType string) bool {
+	return mediaType == MediaTypeDockerManifestList || mediaType == MediaTypeOCIIndex
+}
+
+// IsManifest tells if the media type is an image manifest
+func IsManifest(mediaType string) bool {
+	return mediaType == MediaTypeDockerManifest || mediaType == MediaTypeOCIManifest
+}
+
+// ForPlatform returns the first manifest of the index built for the platform
+func (i Index) ForPlatform(p Platform) (Descriptor, bool) {
+	for _, m := range i.Manifests {
+		if m.Platform != nil && p.Matches(*m.Platform) {
+			return m, true
+		}
+	}
+	return Descriptor{}, false
+}
+
+// Platforms lists the platforms the index has manifests for, for the error messages
+func (i Index) Platforms() []string {
+	var platforms []string
+	for _, m := range i.Manifests {
+		if m.Platform != nil {
+			platforms = append(platforms, m.Platform.String())
+		}
+	}
+	return platforms
+}
+
+// Config is the image configuration blob
+type Config struct {
+	Created      *time.Time      `json:"created,omitempty"`
+	Author       string          `json:"author,omitempty"`
+	Architecture string          `json:"architecture"`
+	OS           string          `json:"os"`
+	Variant      string          `json:"variant,omitempty"`
+	Config       ContainerConfig `json:"config"`
+	RootFS       RootFS          `json:"rootfs"`
+	History      []History       `json:"history,omitempty"`
+}
+
+// ContainerConfig is the runtime configuration of the containers started from the image
+type ContainerConfig struct {
+	User         string              `json:"User,omitempty"`
+	ExposedPorts map[string]struct{} `json:"ExposedPorts,omitempty"`
+	Env          []string            `json:"Env,omitempty"`
+	Entrypoint   []string            `json:"Entrypoint,omitempty"`
+	Cmd          []string            `json:"Cmd,omitempty"`
+	Volumes      map[string]struct{} `json:"Volumes,omitempty"`
+	WorkingDir   string              `json:"WorkingDir,omitempty"`
+	Labels       map[string]string   `json:"Labels,omitempty"`
+	StopSignal   string              `json:"StopSignal,omitempty"`
+	Healthcheck  *HealthConfig       `json:"Healthcheck,omitempty"`
+}
+
+// HealthConfig is how the health of the containers is checked, durations are in nanoseconds
+type HealthConfig struct {
+	Test        []string      `json:"Test,omitempty"` // NONE, or CMD and CMD-SHELL followed by the command
+	Interval    time.Duration `json:"Interval,omitempty"`
+	Timeout     time.Duration `json:"Timeout,omitempty"`
+	StartPeriod time.Duration `json:"StartPeriod,omitempty"`
+	Retries     int           `json:"Retries,omitempty"`
+}
+
+// RootFS lists the uncompressed digests of the layers
+type RootFS struct {
+	Type    string   `json:"type"`
+	DiffIDs []string `json:"diff_ids"`
+}
+
+// History records how a layer was made
+type History struct {
+	Created    *time.Time `json:"created,omitempty"`
+	CreatedBy  string     `json:"created_by,omitempty"`
+	Author     string     `json:"author,omitempty"`
+	Comment    string     `json:"comment,omitempty"`
+	EmptyLayer bool       `json:"empty_layer,omitempty"`
+}
+
+// Digester computes a sha256 digest of what is written to it
+type Digester struct {
+	hash hash.Hash
+}
+
+// NewDigester returns a sha256 Digester
+func NewDigester() *Digester {
+	return &Digester{hash: sha256.New()}
+}
+
+func (d *Digester) Write(p []byte) (int, error) {
+	return d.hash.Write(p)
+}
+
+// Digest returns the digest in the "sha256:<hex>" form
+func (d *Digester) Digest() string {
+	return "sha256:" + hex.EncodeToString(d.hash.Sum(nil))
+}
+
+// FromBytes returns the sha256 digest of b
+func FromBytes(b []byte) string {
+	d := NewDigester()
+	d.Write(b)
+	return d.Digest()
+}
+
+// ValidateDigest checks the digest is a supported "algorithm:hex" string
+func ValidateDigest(digest string) error {
+	parts := strings.SplitN(digest, ":", 2)
+	if len(parts) != 2 || parts[0] != "sha256" || len(parts[1]) != 64 {
+		return fmt.Errorf("unsupported digest %q", digest)
+	}
+	if _, err := hex.DecodeString(parts[1]); err != nil {
+		return fmt.Errorf("invalid digest %q: %s", digest, err)
+	}
+	return nil
+}
+
+// VerifyingReader checks, once the content is read up to EOF, that it matches the expected digest
+type VerifyingReader struct {
+	r        io.Reader
+	digester *Digester
+	expected string
+}
+
+// NewVerifyingReader wraps r, its reads fail at EOF if the content doesn't match digest
+func NewVerifyingReader(r io.Reader, digest string) *VerifyingReader {
+	d := NewDigester()
+	return &VerifyingReader{r: io.TeeReader(r, d), digester: d, expected: digest}
+}
+
+func (v *VerifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	if err == io.EOF {
+		if got := v.digester.Digest(); got != v.expected {
+			return n, fmt.Errorf("digest mismatch: expected %s, got %s", v.expected, got)
+		}
+	}
+	return n, err
+}
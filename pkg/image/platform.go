@@ -0,0 +1,67 @@
+package image
+
+import (
+	"fmt"
+	"runtime"
+	"strings"
+)
+
+// archAliases maps the architecture names used by distributions to the GOARCH ones images use
+var archAliases = map[string]string{
+	"x86_64":  "amd64",
+	"x86-64":  "amd64",
+	"aarch64": "arm64",
+	"armhf":   "arm",
+	"armel":   "arm",
+	"i386":    "386",
+	"i686":    "386",
+}
+
+// ParsePlatform parses an "os/architecture[/variant]" platform, e.g. "linux/arm/v7"
+func ParsePlatform(s string) (Platform, error) {
+	parts := strings.Split(strings.ToLower(s), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return Platform{}, fmt.Errorf("invalid platform %q (expected os/architecture[/variant], e.g. linux/arm/v7)", s)
+	}
+	p := Platform{OS: parts[0], Architecture: parts[1]}
+	if alias, ok := archAliases[p.Architecture]; ok {
+		p.Architecture = alias
+	}
+	if len(parts) == 3 {
+		p.Variant = parts[2]
+	}
+	return p, nil
+}
+
+// HostPlatform is the platform of the running binary
+func HostPlatform() Platform {
+	return Platform{OS: "linux", Architecture: runtime.GOARCH}
+}
+
+func (p Platform) String() string {
+	if p.Variant != "" {
+		return p.OS + "/" + p.Architecture + "/" + p.Variant
+	}
+	return p.OS + "/" + p.Architecture
+}
+
+// Matches tells if an image built for other runs on p. A variant is only compared when
+// p asks for one, arm64 images with no variant are v8.
+func (p Platform) Matches(other Platform) bool {
+	if p.OS != other.OS || p.Architecture != other.Architecture {
+		return false
+	}
+	if p.Variant == "" {
+		return true
+	}
+	variant := other.Variant
+	if variant == "" && other.Architecture == "arm64" {
+		variant = "v8"
+	}
+	return p.Variant == variant
+}
+
+// Platform returns the platform the image was built for
+func (c Config) Platform() Platform {
+	return Platform{OS: c.OS, Architecture: c.Architecture, Variant: c.Variant}
+}
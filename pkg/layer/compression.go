@@ -0,0 +1,69 @@
+package layer
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"syscall"
+)
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte{0x42, 0x5a, 0x68}
+	xzMagic    = []byte{0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00}
+)
+
+// Decompress detects the compression of the stream, if any, and returns it decompressed.
+// xz has no native decoder, it is handed to the xz binary.
+func Decompress(in io.Reader) (io.ReadCloser, error) {
+	buf := bufio.NewReader(in)
+	magic, _ := buf.Peek(6)
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return gzip.NewReader(buf)
+	case bytes.HasPrefix(magic, bzip2Magic):
+		return ioutil.NopCloser(bzip2.NewReader(buf)), nil
+	case bytes.HasPrefix(magic, xzMagic):
+		return xzDecompress(buf)
+	}
+	return ioutil.NopCloser(buf), nil
+}
+
+type cmdReader struct {
+	io.Reader
+	out io.Closer
+	cmd *exec.Cmd
+}
+
+// Close stops the command, which may still be writing: the reader can stop before the end
+// of the stream, on a bad entry, and nobody would drain the pipe anymore.
+func (c *cmdReader) Close() error {
+	c.out.Close()
+	c.cmd.Process.Kill()
+	err := c.cmd.Wait()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() &&
+			(status.Signal() == syscall.SIGKILL || status.Signal() == syscall.SIGPIPE) {
+			return nil
+		}
+	}
+	return err
+}
+
+func xzDecompress(in io.Reader) (io.ReadCloser, error) {
+	cmd := exec.Command("xz", "-d", "-c", "-q")
+	cmd.Stdin = in
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	return &cmdReader{Reader: out, out: out, cmd: cmd}, nil
+}
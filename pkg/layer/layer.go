@@ -0,0 +1,348 @@
+// Package layer applies image layers on a root filesystem, with the OCI whiteout semantics
+package layer
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	log "github.com/spf13/jwalterweatherman"
+	"golang.org/x/sys/unix"
+)
+
+// Whiteout markers: a .wh.<name> entry deletes <name> from the lower layers,
+// the opaque marker hides the whole content of its directory
+const (
+	WhiteoutPrefix = ".wh."
+	WhiteoutOpaque = WhiteoutPrefix + WhiteoutPrefix + ".opq"
+)
+
+// Options tunes how a layer is applied
+type Options struct {
+	Exclude      []string // paths, relative to the root, skipped with their content (e.g. "dev")
+	Unprivileged bool     // skip device nodes, ownership and privileged xattrs, default when not root
+	NoWhiteouts  bool     // extract .wh. files as they are, for plain filesystem tars such as container exports
+	Progress     func(Stats)
+}
+
+// Stats tells how much of a layer was applied
+type Stats struct {
+	Files int64 // entries applied
+	Bytes int64 // uncompressed bytes read
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("%d files, %.1f MB", s.Files, float64(s.Bytes)/(1<<20))
+}
+
+// Apply streams the, possibly compressed, layer tar onto root. Whiteouts and opaque
+// directories delete what the lower layers put in root.
+func Apply(in io.Reader, root string, opts Options) (Stats, error) {
+	var stats Stats
+
+	r, err := Decompress(in)
+	if err != nil {
+		return stats, err
+	}
+	defer r.Close()
+
+	if os.Geteuid() != 0 {
+		opts.Unprivileged = true
+	}
+
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return stats, err
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return stats, err
+	}
+
+	a := &applier{
+		root:    root,
+		opts:    opts,
+		created: map[string]bool{},
+	}
+
+	counter := &countingReader{r: r}
+	tr := tar.NewReader(counter)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stats, err
+		}
+
+		if err := a.entry(hdr, tr); err != nil {
+			return stats, fmt.Errorf("%s: %s", hdr.Name, err)
+		}
+
+		stats.Files++
+		stats.Bytes = counter.n
+		if opts.Progress != nil {
+			opts.Progress(stats)
+		}
+	}
+
+	// Directories get their times last, writing their content changed them
+	for i := len(a.dirs) - 1; i >= 0; i-- {
+		d := a.dirs[i]
+		os.Chtimes(d.path, d.atime, d.mtime)
+	}
+
+	stats.Bytes = counter.n
+	return stats, nil
+}
+
+type dirTimes struct {
+	path         string
+	atime, mtime time.Time
+}
+
+type applier struct {
+	root    string
+	opts    Options
+	created map[string]bool // paths written by this layer, opaque markers only hide the lower ones
+	dirs    []dirTimes
+}
+
+func (a *applier) excluded(name string) bool {
+	for _, e := range a.opts.Exclude {
+		e = strings.Trim(filepath.Clean(e), "/")
+		if name == e || strings.HasPrefix(name, e+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (a *applier) entry(hdr *tar.Header, content io.Reader) error {
+	name := strings.TrimPrefix(filepath.Clean("/"+hdr.Name), "/")
+	if name == "" {
+		name = "."
+	}
+	if a.excluded(name) {
+		return nil
+	}
+
+	dir, base := filepath.Split(name)
+	parent, err := SecureJoin(a.root, dir)
+	if err != nil {
+		return err
+	}
+
+	if !a.opts.NoWhiteouts && strings.HasPrefix(base, WhiteoutPrefix) {
+		if base == WhiteoutOpaque {
+			return a.opaque(parent, dir)
+		}
+		// The whited out name is a plain entry of parent, .wh.. and .wh... would be parent and its own parent
+		whited := strings.TrimPrefix(base, WhiteoutPrefix)
+		if whited == "" || whited == "." || whited == ".." || strings.Contains(whited, "/") {
+			return fmt.Errorf("invalid whiteout %q", base)
+		}
+		target := filepath.Join(parent, whited)
+		if !within(a.root, target) {
+			return fmt.Errorf("whiteout %s is out of the root", target)
+		}
+		log.TRACE.Println("whiteout", target)
+		return os.RemoveAll(target)
+	}
+
+	if err := os.MkdirAll(parent, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(parent, base)
+	if name == "." {
+		path = a.root
+	}
+
+	// Replace whatever is there, unless both are directories
+	if fi, err := os.Lstat(path); err == nil {
+		if !(fi.IsDir() && hdr.Typeflag == tar.TypeDir) {
+			if err := os.RemoveAll(path); err != nil {
+				return err
+			}
+		}
+	}
+
+	mode := uint32(hdr.Mode & 07777)
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		if err := os.Mkdir(path, os.FileMode(mode)); err != nil && !os.IsExist(err) {
+			return err
+		}
+	case tar.TypeReg, tar.TypeRegA:
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(mode))
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, content)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	case tar.TypeSymlink:
+		if err := os.Symlink(hdr.Linkname, path); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		linkName := strings.TrimPrefix(filepath.Clean("/"+hdr.Linkname), "/")
+		target, err := SecureJoin(a.root, linkName)
+		if err != nil {
+			return err
+		}
+		if err := os.Link(target, path); err != nil {
+			return err
+		}
+	case tar.TypeChar, tar.TypeBlock:
+		if a.opts.Unprivileged {
+			log.DEBUG.Println("Skipping device node", name, "(unprivileged)")
+			return nil
+		}
+		devMode := uint32(unix.S_IFCHR)
+		if hdr.Typeflag == tar.TypeBlock {
+			devMode = unix.S_IFBLK
+		}
+		if err := unix.Mknod(path, devMode|mode, int(unix.Mkdev(uint32(hdr.Devmajor), uint32(hdr.Devminor)))); err != nil {
+			return err
+		}
+	case tar.TypeFifo:
+		if err := unix.Mkfifo(path, mode); err != nil {
+			return err
+		}
+	case tar.TypeXGlobalHeader:
+		return nil
+	default:
+		log.WARN.Printf("Skipping %s: unsupported type %c\n", name, hdr.Typeflag)
+		return nil
+	}
+	a.created[path] = true
+
+	return a.metadata(hdr, path, mode)
+}
+
+// metadata restores ownership, xattrs, permissions and times. Chown goes first, it clears setuid bits.
+func (a *applier) metadata(hdr *tar.Header, path string, mode uint32) error {
+	if !a.opts.Unprivileged {
+		if err := os.Lchown(path, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+	}
+
+	for key, value := range hdr.Xattrs {
+		if a.opts.Unprivileged && (strings.HasPrefix(key, "trusted.") || strings.HasPrefix(key, "security.")) {
+			continue
+		}
+		if err := unix.Lsetxattr(path, key, []byte(value), 0); err != nil {
+			if err == unix.ENOTSUP || err == unix.EPERM {
+				log.DEBUG.Println("Could not set xattr", key, "on", path, err)
+				continue
+			}
+			return err
+		}
+	}
+
+	if hdr.Typeflag == tar.TypeSymlink {
+		tv := []unix.Timeval{unix.NsecToTimeval(hdr.AccessTime.UnixNano()), unix.NsecToTimeval(hdr.ModTime.UnixNano())}
+		if hdr.AccessTime.IsZero() {
+			tv[0] = tv[1]
+		}
+		unix.Lutimes(path, tv)
+		return nil
+	}
+
+	if hdr.Typeflag != tar.TypeLink {
+		if err := os.Chmod(path, os.FileMode(mode&0777)|modeBits(mode)); err != nil {
+			return err
+		}
+	}
+
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+	if hdr.Typeflag == tar.TypeDir {
+		a.dirs = append(a.dirs, dirTimes{path: path, atime: atime, mtime: hdr.ModTime})
+		return nil
+	}
+	if hdr.Typeflag != tar.TypeLink {
+		return os.Chtimes(path, atime, hdr.ModTime)
+	}
+	return nil
+}
+
+// opaque removes what the lower layers have in the directory, keeping what this layer wrote.
+// A directory this layer wrote over a lower one still loses the lower content.
+func (a *applier) opaque(path string, name string) error {
+	log.TRACE.Println("opaque", name)
+	return a.removeLower(path)
+}
+
+func (a *applier) removeLower(path string) error {
+	entries, err := readDirNames(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	for _, e := range entries {
+		child := filepath.Join(path, e)
+		if !a.created[child] {
+			if err := os.RemoveAll(child); err != nil {
+				return err
+			}
+			continue
+		}
+		if fi, err := os.Lstat(child); err == nil && fi.IsDir() {
+			if err := a.removeLower(child); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func readDirNames(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
+
+// modeBits converts the setuid, setgid and sticky bits of a tar mode to os.FileMode ones
+func modeBits(mode uint32) os.FileMode {
+	var m os.FileMode
+	if mode&syscall.S_ISUID != 0 {
+		m |= os.ModeSetuid
+	}
+	if mode&syscall.S_ISGID != 0 {
+		m |= os.ModeSetgid
+	}
+	if mode&syscall.S_ISVTX != 0 {
+		m |= os.ModeSticky
+	}
+	return m
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
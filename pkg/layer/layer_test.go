@@ -0,0 +1,259 @@
+package layer
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// entry is a tar entry of a test layer: a directory when the name ends with a slash,
+// a symlink or a hardlink when link is set, a file holding its name otherwise
+type entry struct {
+	name string
+	link string
+	hard bool
+}
+
+func layerTar(t *testing.T, entries ...entry) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Typeflag: tar.TypeReg}
+		switch {
+		case strings.HasSuffix(e.name, "/"):
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0755
+		case e.hard:
+			hdr.Typeflag, hdr.Linkname = tar.TypeLink, e.link
+		case e.link != "":
+			hdr.Typeflag, hdr.Linkname = tar.TypeSymlink, e.link
+		default:
+			hdr.Size = int64(len(e.name))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			tw.Write([]byte(e.name))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+// sandbox makes a directory holding the root the layers are applied on, and a file next to it
+func sandbox(t *testing.T) (dir string, root string, sibling string) {
+	dir, err := ioutil.TempDir("", "layer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	root = filepath.Join(dir, "root")
+	sibling = filepath.Join(dir, "sibling")
+	if err := os.Mkdir(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(sibling, []byte("keep"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir, root, sibling
+}
+
+// tree lists the content of root, directories with a trailing slash
+func tree(t *testing.T, root string) []string {
+	var names []string
+	err := filepath.Walk(root, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || path == root {
+			return err
+		}
+		rel, _ := filepath.Rel(root, path)
+		if fi.IsDir() {
+			rel += "/"
+		}
+		names = append(names, rel)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func apply(t *testing.T, root string, entries ...entry) error {
+	_, err := Apply(layerTar(t, entries...), root, Options{Unprivileged: true})
+	return err
+}
+
+func TestMaliciousWhiteouts(t *testing.T) {
+	for _, name := range []string{".wh..", ".wh...", "dir/.wh..", "dir/.wh...", "dir/.wh.", "../.wh.sibling", ".wh../sibling"} {
+		dir, root, sibling := sandbox(t)
+		if err := apply(t, root, entry{name: "dir/"}, entry{name: "dir/file"}, entry{name: "file"}); err != nil {
+			t.Fatal(err)
+		}
+
+		err := apply(t, root, entry{name: name})
+		if _, serr := os.Stat(sibling); serr != nil {
+			t.Errorf("%s: removed the file next to the root", name)
+		}
+		if _, serr := os.Stat(root); serr != nil {
+			t.Errorf("%s: removed the root", name)
+		} else if got := tree(t, root); len(got) < 2 {
+			t.Errorf("%s: removed %v from the root", name, got)
+		}
+		if err == nil && !strings.HasPrefix(name, "../") && !strings.HasPrefix(name, ".wh../") {
+			t.Errorf("%s: applied without error", name)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestWhiteoutThroughSymlink(t *testing.T) {
+	dir, root, sibling := sandbox(t)
+	defer os.RemoveAll(dir)
+
+	// The link resolves to the root of the layers, not the directory holding it
+	err := apply(t, root, entry{name: "escape", link: ".."}, entry{name: "abs", link: "/"}, entry{name: "sibling"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := apply(t, root, entry{name: "escape/.wh.sibling"}, entry{name: "abs/.wh.escape"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(sibling); err != nil {
+		t.Error("removed the file next to the root")
+	}
+	if got, want := tree(t, root), []string{"abs"}; !equal(got, want) {
+		t.Errorf("root has %v, want %v", got, want)
+	}
+}
+
+func TestWhiteout(t *testing.T) {
+	dir, root, _ := sandbox(t)
+	defer os.RemoveAll(dir)
+
+	if err := apply(t, root, entry{name: "etc/"}, entry{name: "etc/a"}, entry{name: "etc/b"}, entry{name: "var/"}, entry{name: "var/c"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := apply(t, root, entry{name: "etc/.wh.a"}, entry{name: ".wh.var"}, entry{name: "etc/.wh.missing"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tree(t, root), []string{"etc/", "etc/b"}; !equal(got, want) {
+		t.Errorf("root has %v, want %v", got, want)
+	}
+}
+
+func TestOpaque(t *testing.T) {
+	dir, root, _ := sandbox(t)
+	defer os.RemoveAll(dir)
+
+	if err := apply(t, root, entry{name: "etc/"}, entry{name: "etc/a"}, entry{name: "etc/sub/"}, entry{name: "etc/sub/b"}, entry{name: "keep"}); err != nil {
+		t.Fatal(err)
+	}
+	// What the layer writes stays, wherever the marker is
+	if err := apply(t, root, entry{name: "etc/"}, entry{name: "etc/c"}, entry{name: "etc/.wh..wh..opq"}, entry{name: "etc/d"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tree(t, root), []string{"etc/", "etc/c", "etc/d", "keep"}; !equal(got, want) {
+		t.Errorf("root has %v, want %v", got, want)
+	}
+
+	// A directory written again by the layer loses its lower content too
+	if err := apply(t, root, entry{name: "etc/sub/"}, entry{name: "etc/sub/b"}, entry{name: "etc/sub/deep/"}, entry{name: "etc/sub/deep/e"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := apply(t, root, entry{name: "etc/sub/"}, entry{name: "etc/sub/f"}, entry{name: "etc/sub/deep/"}, entry{name: "etc/.wh..wh..opq"}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tree(t, root), []string{"etc/", "etc/sub/", "etc/sub/deep/", "etc/sub/f", "keep"}; !equal(got, want) {
+		t.Errorf("root has %v, want %v", got, want)
+	}
+
+	// Opaque markers of missing directories are no-ops
+	if err := apply(t, root, entry{name: "missing/.wh..wh..opq"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestHardlinks(t *testing.T) {
+	dir, root, sibling := sandbox(t)
+	defer os.RemoveAll(dir)
+
+	err := apply(t, root,
+		entry{name: "bin/"},
+		entry{name: "bin/busybox"},
+		entry{name: "bin/sh", link: "bin/busybox", hard: true},
+		entry{name: "bin/ls", link: "/bin/busybox", hard: true},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	target, err := os.Stat(filepath.Join(root, "bin", "busybox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"sh", "ls"} {
+		fi, err := os.Stat(filepath.Join(root, "bin", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !os.SameFile(fi, target) {
+			t.Errorf("bin/%s is not a hardlink of bin/busybox", name)
+		}
+	}
+
+	// Links resolve in the root, never to the files around it
+	if err := apply(t, root, entry{name: "escape", link: "../sibling", hard: true}); err == nil {
+		fi, _ := os.Stat(filepath.Join(root, "escape"))
+		sfi, _ := os.Stat(sibling)
+		if fi != nil && sfi != nil && os.SameFile(fi, sfi) {
+			t.Error("hardlinked the file next to the root")
+		}
+	}
+	if err := apply(t, root, entry{name: "link", link: "bin", hard: false}, entry{name: "escape2", link: "link/../../sibling", hard: true}); err == nil {
+		t.Error("hardlinked a file missing from the root")
+	}
+}
+
+func TestXzCloseEarly(t *testing.T) {
+	if _, err := exec.LookPath("xz"); err != nil {
+		t.Skip("no xz")
+	}
+	// Far more than a pipe holds, once decompressed
+	var compressed bytes.Buffer
+	cmd := exec.Command("xz", "-c")
+	cmd.Stdin = bytes.NewReader(make([]byte, 8<<20))
+	cmd.Stdout = &compressed
+	if err := cmd.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := Decompress(&compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Read(make([]byte, 512)); err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- r.Close() }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Error(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("Close blocked on xz")
+	}
+}
+
+func equal(a, b []string) bool {
+	return strings.Join(a, "\n") == strings.Join(b, "\n")
+}
@@ -0,0 +1,66 @@
+package layer
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxSymlinks bounds the symlinks followed resolving a path, like the kernel does
+const maxSymlinks = 255
+
+// SecureJoin joins root and the relative path, resolving the symlinks met on the way as
+// if root was /: the result never points outside of root.
+func SecureJoin(root string, path string) (string, error) {
+	var resolved string // relative to root, always clean
+	remaining := filepath.Clean("/" + path)
+	links := 0
+
+	for remaining != "" && remaining != "/" {
+		remaining = strings.TrimPrefix(remaining, "/")
+		var part string
+		if i := strings.IndexByte(remaining, '/'); i == -1 {
+			part, remaining = remaining, ""
+		} else {
+			part, remaining = remaining[:i], remaining[i:]
+		}
+
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir("/" + resolved)[1:]
+			continue
+		}
+
+		next := filepath.Join(resolved, part)
+		fi, err := os.Lstat(filepath.Join(root, next))
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			// missing components are created later, as directories
+			resolved = next
+			continue
+		}
+
+		links++
+		if links > maxSymlinks {
+			return "", errors.New("too many levels of symbolic links")
+		}
+		target, err := os.Readlink(filepath.Join(root, next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = ""
+		}
+		remaining = target + "/" + remaining
+	}
+
+	return filepath.Join(root, resolved), nil
+}
+
+// within tells if path is below root, root itself excluded
+func within(root string, path string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, "../")
+}
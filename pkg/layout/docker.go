@@ -0,0 +1,120 @@
+package layout
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	log "github.com/spf13/jwalterweatherman"
+
+	"github.com/mudler/artemide/pkg/image"
+	"github.com/mudler/artemide/pkg/layer"
+)
+
+// DockerManifest is an entry of the manifest.json written by docker save
+type DockerManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// UnpackDockerArchive applies on dest the layers of an image saved with docker save, as a
+// tar or extracted in a directory. name picks the image by tag when the archive holds
+// more than one; when a platform is given, the image must be built for it.
+// It returns the image id and its configuration.
+func UnpackDockerArchive(archive string, name string, platform image.Platform, dest string) (string, image.Config, error) {
+	var config image.Config
+	s, err := openStore(archive)
+	if err != nil {
+		return "", config, err
+	}
+	defer s.Close()
+
+	body, err := readFile(s, "manifest.json")
+	if err != nil {
+		return "", config, fmt.Errorf("%s: not a docker save archive (only the format of docker 1.10 and later is supported): %s", archive, err)
+	}
+	var manifests []DockerManifest
+	if err := json.Unmarshal(body, &manifests); err != nil {
+		return "", config, fmt.Errorf("%s: invalid manifest.json: %s", archive, err)
+	}
+
+	m, err := selectDockerManifest(manifests, name)
+	if err != nil {
+		return "", config, fmt.Errorf("%s: %s", archive, err)
+	}
+
+	body, err = readFile(s, m.Config)
+	if err != nil {
+		return "", config, fmt.Errorf("%s: %s", archive, err)
+	}
+	if config, err = parseConfig(body); err != nil {
+		return "", config, fmt.Errorf("%s: %s", archive, err)
+	}
+	if platform.OS != "" {
+		if err := checkPlatform(config, platform); err != nil {
+			return "", config, fmt.Errorf("%s: %s", archive, err)
+		}
+	}
+
+	for i, l := range m.Layers {
+		log.INFO.Printf("Layer %d/%d %s\n", i+1, len(m.Layers), l)
+		if err := applyLayer(s, l, dest, ""); err != nil {
+			return "", config, fmt.Errorf("layer %s: %s", l, err)
+		}
+	}
+
+	return "sha256:" + strings.TrimSuffix(path.Base(m.Config), ".json"), config, nil
+}
+
+func selectDockerManifest(manifests []DockerManifest, name string) (DockerManifest, error) {
+	if name == "" {
+		if len(manifests) != 1 {
+			return DockerManifest{}, fmt.Errorf("%d images in the archive, the image to unpack must be given", len(manifests))
+		}
+		return manifests[0], nil
+	}
+
+	wanted := []string{name}
+	if !strings.Contains(path.Base(name), ":") {
+		wanted = append(wanted, name+":latest")
+	}
+	var tags []string
+	for _, m := range manifests {
+		for _, tag := range m.RepoTags {
+			for _, w := range wanted {
+				if tag == w {
+					return m, nil
+				}
+			}
+			tags = append(tags, tag)
+		}
+	}
+	return DockerManifest{}, fmt.Errorf("no image %s in the archive (found %v)", name, tags)
+}
+
+// applyLayer applies the named layer of the store, verifying its digest when given
+func applyLayer(s store, name string, dest string, digest string) error {
+	r, err := s.Open(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	var in io.Reader = r
+	if digest != "" {
+		in = image.NewVerifyingReader(r, digest)
+	}
+	stats, err := layer.Apply(in, dest, layer.Options{})
+	if err != nil {
+		return err
+	}
+	log.DEBUG.Printf("Applied %d entries, %d bytes\n", stats.Files, stats.Bytes)
+
+	// The digest is checked at EOF, past the end of the tar
+	_, err = io.Copy(ioutil.Discard, in)
+	return err
+}
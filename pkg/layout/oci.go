@@ -0,0 +1,184 @@
+package layout
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	log "github.com/spf13/jwalterweatherman"
+
+	"github.com/mudler/artemide/pkg/image"
+)
+
+// RefNameAnnotation names the manifests of an OCI layout index
+const RefNameAnnotation = "org.opencontainers.image.ref.name"
+
+type ociLayout struct {
+	ImageLayoutVersion string `json:"imageLayoutVersion"`
+}
+
+// UnpackOCILayout applies on dest the layers of an image in OCI image layout, as a
+// directory or a tar. name picks the manifest by its ref name annotation when the index
+// holds more than one, platform the manifest in nested indexes, the host one when empty.
+// It returns the manifest digest and the image configuration.
+func UnpackOCILayout(layout string, name string, platform image.Platform, dest string) (string, image.Config, error) {
+	var config image.Config
+	s, err := openStore(layout)
+	if err != nil {
+		return "", config, err
+	}
+	defer s.Close()
+
+	body, err := readFile(s, "oci-layout")
+	if err != nil {
+		return "", config, fmt.Errorf("%s: not an OCI image layout: %s", layout, err)
+	}
+	var version ociLayout
+	if err := json.Unmarshal(body, &version); err != nil || version.ImageLayoutVersion == "" {
+		return "", config, fmt.Errorf("%s: invalid oci-layout file", layout)
+	}
+
+	body, err = readFile(s, "index.json")
+	if err != nil {
+		return "", config, fmt.Errorf("%s: %s", layout, err)
+	}
+	var index image.Index
+	if err := json.Unmarshal(body, &index); err != nil {
+		return "", config, fmt.Errorf("%s: invalid index.json: %s", layout, err)
+	}
+
+	desc, err := selectOCIManifest(index, name)
+	if err != nil {
+		return "", config, fmt.Errorf("%s: %s", layout, err)
+	}
+
+	manifest, digest, config, err := resolve(s, desc, platform)
+	if err != nil {
+		return "", config, fmt.Errorf("%s: %s", layout, err)
+	}
+
+	for i, l := range manifest.Layers {
+		log.INFO.Printf("Layer %d/%d %s (%d bytes)\n", i+1, len(manifest.Layers), l.Digest, l.Size)
+		if err := image.ValidateDigest(l.Digest); err != nil {
+			return "", config, err
+		}
+		if err := applyLayer(s, blobPath(l.Digest), dest, l.Digest); err != nil {
+			return "", config, fmt.Errorf("layer %s: %s", l.Digest, err)
+		}
+	}
+	return digest, config, nil
+}
+
+func selectOCIManifest(index image.Index, name string) (image.Descriptor, error) {
+	if name == "" {
+		if len(index.Manifests) != 1 {
+			return image.Descriptor{}, fmt.Errorf("%d manifests in the index, the image to unpack must be given", len(index.Manifests))
+		}
+		return index.Manifests[0], nil
+	}
+
+	var names []string
+	for _, m := range index.Manifests {
+		ref := m.Annotations[RefNameAnnotation]
+		if ref == name {
+			return m, nil
+		}
+		if ref != "" {
+			names = append(names, ref)
+		}
+	}
+	return image.Descriptor{}, fmt.Errorf("no image %s in the index (found %v)", name, names)
+}
+
+// resolve follows the nested indexes down to the manifest of the platform, and reads its
+// configuration. A manifest referenced directly is checked against the platform, when one was given.
+func resolve(s store, desc image.Descriptor, platform image.Platform) (image.Manifest, string, image.Config, error) {
+	var manifest image.Manifest
+	var config image.Config
+
+	wanted := platform
+	if wanted.OS == "" {
+		wanted = image.HostPlatform()
+	}
+	nested := false
+
+	for depth := 0; image.IsIndex(desc.MediaType); depth++ {
+		if depth > 8 {
+			return manifest, "", config, fmt.Errorf("too many nested indexes")
+		}
+		body, err := readBlob(s, desc.Digest)
+		if err != nil {
+			return manifest, "", config, err
+		}
+		var index image.Index
+		if err := json.Unmarshal(body, &index); err != nil {
+			return manifest, "", config, fmt.Errorf("invalid index %s: %s", desc.Digest, err)
+		}
+		selected, ok := index.ForPlatform(wanted)
+		if !ok {
+			return manifest, "", config, fmt.Errorf("index %s has no manifest for %s (available: %s)", desc.Digest, wanted, strings.Join(index.Platforms(), ", "))
+		}
+		desc = selected
+		nested = true
+	}
+
+	if !image.IsManifest(desc.MediaType) {
+		return manifest, "", config, fmt.Errorf("%s: unsupported manifest type %q", desc.Digest, desc.MediaType)
+	}
+	body, err := readBlob(s, desc.Digest)
+	if err != nil {
+		return manifest, "", config, err
+	}
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return manifest, "", config, fmt.Errorf("invalid manifest %s: %s", desc.Digest, err)
+	}
+
+	body, err = readBlob(s, manifest.Config.Digest)
+	if err != nil {
+		return manifest, "", config, err
+	}
+	if config, err = parseConfig(body); err != nil {
+		return manifest, "", config, err
+	}
+	if !nested && platform.OS != "" {
+		if err := checkPlatform(config, platform); err != nil {
+			return manifest, "", config, err
+		}
+	}
+	return manifest, desc.Digest, config, nil
+}
+
+// readBlob reads a blob, small enough to be verified in memory
+func readBlob(s store, digest string) ([]byte, error) {
+	if err := image.ValidateDigest(digest); err != nil {
+		return nil, err
+	}
+	body, err := readFile(s, blobPath(digest))
+	if err != nil {
+		return nil, err
+	}
+	if got := image.FromBytes(body); got != digest {
+		return nil, fmt.Errorf("blob %s: digest mismatch, got %s", digest, got)
+	}
+	return body, nil
+}
+
+func blobPath(digest string) string {
+	return "blobs/" + strings.Replace(digest, ":", "/", 1)
+}
+
+func parseConfig(body []byte) (image.Config, error) {
+	var config image.Config
+	if err := json.Unmarshal(body, &config); err != nil {
+		return config, fmt.Errorf("invalid image config: %s", err)
+	}
+	return config, nil
+}
+
+// checkPlatform fails if the image config isn't built for the platform
+func checkPlatform(config image.Config, platform image.Platform) error {
+	if !platform.Matches(config.Platform()) {
+		return fmt.Errorf("the image is built for %s, not %s", config.Platform(), platform)
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+// Package layout unpacks images stored locally, as docker save archives or OCI image layouts
+package layout
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/mudler/artemide/pkg/layer"
+)
+
+// store reads the files of an image, from a directory or a tar
+type store interface {
+	Open(name string) (io.ReadCloser, error)
+	Close() error
+}
+
+// openStore opens path as a directory, or as a tar. Compressed tars are decompressed
+// to a temporary file first, the files are read in place from uncompressed ones.
+func openStore(p string) (store, error) {
+	fi, err := os.Stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		return &dirStore{root: p}, nil
+	}
+	return openTarStore(p)
+}
+
+func cleanName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
+
+type dirStore struct {
+	root string
+}
+
+func (d *dirStore) Open(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(d.root, filepath.FromSlash(cleanName(name))))
+}
+
+func (d *dirStore) Close() error {
+	return nil
+}
+
+type section struct {
+	offset, size int64
+}
+
+type tarStore struct {
+	f        *os.File
+	tmp      string
+	files    map[string]section
+	symlinks map[string]string
+}
+
+func openTarStore(p string) (*tarStore, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, err
+	}
+	t := &tarStore{f: f, files: map[string]section{}, symlinks: map[string]string{}}
+
+	// Compressed archives may be smaller than a tar header
+	header := make([]byte, 512)
+	n, err := io.ReadFull(f, header)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		f.Close()
+		return nil, fmt.Errorf("%s: not an archive: %s", p, err)
+	}
+	if n < len(header) || !bytes.HasPrefix(header[257:], []byte("ustar")) {
+		if err := t.decompress(); err != nil {
+			t.Close()
+			return nil, fmt.Errorf("%s: %s", p, err)
+		}
+	}
+
+	if err := t.index(); err != nil {
+		t.Close()
+		return nil, fmt.Errorf("%s: %s", p, err)
+	}
+	return t, nil
+}
+
+func (t *tarStore) decompress() error {
+	if _, err := t.f.Seek(0, 0); err != nil {
+		return err
+	}
+	r, err := layer.Decompress(t.f)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	tmp, err := ioutil.TempFile("", "artemide-layout")
+	if err != nil {
+		return err
+	}
+	t.tmp = tmp.Name()
+	if _, err := io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		return err
+	}
+	t.f.Close()
+	t.f = tmp
+	return nil
+}
+
+// index records where the content of each file starts: the tar reader reads the headers
+// without buffering, so the file offset after Next is the one of the content
+func (t *tarStore) index() error {
+	if _, err := t.f.Seek(0, 0); err != nil {
+		return err
+	}
+	tr := tar.NewReader(t.f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		name := cleanName(hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeReg, tar.TypeRegA:
+			offset, err := t.f.Seek(0, 1)
+			if err != nil {
+				return err
+			}
+			t.files[name] = section{offset: offset, size: hdr.Size}
+		case tar.TypeSymlink:
+			t.symlinks[name] = path.Join(path.Dir("/"+name), hdr.Linkname)
+		case tar.TypeLink:
+			t.symlinks[name] = "/" + hdr.Linkname
+		}
+	}
+}
+
+func (t *tarStore) Open(name string) (io.ReadCloser, error) {
+	name = cleanName(name)
+	for i := 0; i < 16; i++ {
+		if s, ok := t.files[name]; ok {
+			return ioutil.NopCloser(io.NewSectionReader(t.f, s.offset, s.size)), nil
+		}
+		target, ok := t.symlinks[name]
+		if !ok {
+			break
+		}
+		name = cleanName(target)
+	}
+	return nil, fmt.Errorf("%s: no such file in the archive", name)
+}
+
+func (t *tarStore) Close() error {
+	err := t.f.Close()
+	if t.tmp != "" {
+		os.Remove(t.tmp)
+	}
+	return err
+}
+
+// readFile reads the named file of the store
+func readFile(s store, name string) ([]byte, error) {
+	r, err := s.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
@@ -0,0 +1,296 @@
+package osutil
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	fp "path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/docker/docker/pkg/mount"
+	log "github.com/spf13/jwalterweatherman"
+	"golang.org/x/sys/unix"
+)
+
+// chrootInitName is the argv[0] RunInRoot re-executes the binary with
+const chrootInitName = "artemide-chroot-init"
+
+// Environment handed to the re-executed binary, stripped before the command runs
+const (
+	envChrootRoot  = "ARTEMIDE_CHROOT_ROOT"
+	envChrootUser  = "ARTEMIDE_CHROOT_USER"
+	envChrootGroup = "ARTEMIDE_CHROOT_GROUP"
+	envChrootCaps  = "ARTEMIDE_CHROOT_CAPS"
+)
+
+// Capabilities maps the capability names to their number
+var Capabilities = map[string]uint{
+	"CHOWN":            0,
+	"DAC_OVERRIDE":     1,
+	"DAC_READ_SEARCH":  2,
+	"FOWNER":           3,
+	"FSETID":           4,
+	"KILL":             5,
+	"SETGID":           6,
+	"SETUID":           7,
+	"SETPCAP":          8,
+	"LINUX_IMMUTABLE":  9,
+	"NET_BIND_SERVICE": 10,
+	"NET_BROADCAST":    11,
+	"NET_ADMIN":        12,
+	"NET_RAW":          13,
+	"IPC_LOCK":         14,
+	"IPC_OWNER":        15,
+	"SYS_MODULE":       16,
+	"SYS_RAWIO":        17,
+	"SYS_CHROOT":       18,
+	"SYS_PTRACE":       19,
+	"SYS_PACCT":        20,
+	"SYS_ADMIN":        21,
+	"SYS_BOOT":         22,
+	"SYS_NICE":         23,
+	"SYS_RESOURCE":     24,
+	"SYS_TIME":         25,
+	"SYS_TTY_CONFIG":   26,
+	"MKNOD":            27,
+	"LEASE":            28,
+	"AUDIT_WRITE":      29,
+	"AUDIT_CONTROL":    30,
+	"SETFCAP":          31,
+}
+
+// DefaultCapabilities are kept in the chroot when none are given, the same docker grants to containers
+var DefaultCapabilities = []string{
+	"CHOWN", "DAC_OVERRIDE", "FOWNER", "FSETID", "KILL", "SETGID", "SETUID", "SETPCAP",
+	"NET_BIND_SERVICE", "NET_RAW", "SYS_CHROOT", "MKNOD", "AUDIT_WRITE", "SETFCAP",
+}
+
+// RootOptions tunes how RunInRoot runs a command
+type RootOptions struct {
+	Binds        []string // host directories mounted in the root, as "src[:dest]"
+	RoBinds      []string // like Binds, but mounted read only
+	User         string   // user name or id the command runs as, looked up in the root
+	Group        string   // group name or id the command runs as, looked up in the root
+	Capabilities []string // capabilities kept in the bounding set, DefaultCapabilities when empty
+	Env          []string // environment of the command
+	Timeout      time.Duration
+	Cancel       <-chan struct{} // kills the command when closed
+	LogPrefix    string
+}
+
+// RunInRoot runs cmd chrooted in rootDir, with /proc, /sys, /dev and the configured
+// directories mounted. Everything mounted is unmounted before returning, even on failure.
+func RunInRoot(rootDir string, cmd []string, opts RootOptions) (err error) {
+	if len(cmd) == 0 {
+		return errors.New("no command to run")
+	}
+
+	rootDir, err = fp.Abs(rootDir)
+	if err != nil {
+		return err
+	}
+
+	caps := opts.Capabilities
+	if len(caps) == 0 {
+		caps = DefaultCapabilities
+	}
+	var keep []string
+	for _, c := range caps {
+		n, ok := Capabilities[strings.TrimPrefix(strings.ToUpper(c), "CAP_")]
+		if !ok {
+			return fmt.Errorf("unknown capability %s", c)
+		}
+		keep = append(keep, strconv.FormatUint(uint64(n), 10))
+	}
+
+	before, err := GetMountsByRoot(rootDir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if uerr := unmountNew(rootDir, before); uerr != nil && err == nil {
+			err = uerr
+		}
+	}()
+
+	if err := mountSystem(rootDir); err != nil {
+		return err
+	}
+	for _, b := range opts.Binds {
+		if err := bindMount(b, rootDir, false); err != nil {
+			return err
+		}
+	}
+	for _, b := range opts.RoBinds {
+		if err := bindMount(b, rootDir, true); err != nil {
+			return err
+		}
+	}
+
+	c := exec.Command("/proc/self/exe", cmd...)
+	c.Args[0] = chrootInitName
+	c.Env = append(append([]string{}, opts.Env...),
+		envChrootRoot+"="+rootDir,
+		envChrootUser+"="+opts.User,
+		envChrootGroup+"="+opts.Group,
+		envChrootCaps+"="+strings.Join(keep, ","),
+	)
+
+	log.DEBUG.Println("chroot:", rootDir, cmd)
+	return RunStreamed(c, opts.LogPrefix, opts.Timeout, opts.Cancel)
+}
+
+// mountSystem mounts the pseudo filesystems most of the tools expect. /dev is a fresh tmpfs
+// holding the few device nodes a build needs, never the host one and its block devices.
+func mountSystem(rootDir string) error {
+	for _, m := range []struct{ device, target, fstype, options string }{
+		{"proc", "/proc", "proc", "nosuid,nodev,noexec"},
+		{"sysfs", "/sys", "sysfs", "nosuid,nodev,noexec"},
+		{"tmpfs", "/dev", "tmpfs", "nosuid,mode=755"},
+	} {
+		target, err := RootPath(rootDir, m.target)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(target, 0755); err != nil {
+			return err
+		}
+		log.DEBUG.Println("mount", m.fstype, "to", target)
+		if err := mount.Mount(m.device, target, m.fstype, m.options); err != nil {
+			if m.target != "/dev" {
+				return fmt.Errorf("Failed to mount %s: %s", target, err)
+			}
+			// The nodes are made in the rootfs /dev then, they stay after the build
+			log.WARN.Println("Could not mount a tmpfs on /dev, creating the device nodes in the rootfs:", err)
+		}
+	}
+	if err := createDevices(rootDir, 0, 0); err != nil {
+		return err
+	}
+
+	// A private instance, the host terminals are not reachable thru it
+	pts, err := RootPath(rootDir, "/dev/pts")
+	if err != nil {
+		return err
+	}
+	if err := mount.Mount("devpts", pts, "devpts", "nosuid,noexec,newinstance,ptmxmode=0666,mode=0620"); err != nil {
+		log.WARN.Println("Could not mount devpts, no terminals in the chroot:", err)
+	}
+	return nil
+}
+
+// unmountNew unmounts, innermost first, what was mounted under rootDir since before was taken
+func unmountNew(rootDir string, before []string) error {
+	mounts, err := GetMountsByRoot(rootDir)
+	if err != nil {
+		return err
+	}
+
+	existing := map[string]bool{}
+	for _, m := range before {
+		existing[m] = true
+	}
+
+	var failed []string
+	for i := len(mounts) - 1; i >= 0; i-- {
+		if existing[mounts[i]] {
+			continue
+		}
+		// Listed in mountinfo, they are mounted even when Mounted can't tell a bind from the same filesystem
+		if err := ForceUnmount(mounts[i], syscall.MNT_DETACH); err != nil {
+			failed = append(failed, mounts[i])
+			continue
+		}
+		log.DEBUG.Println("umount:", mounts[i])
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("Failed to unmount %s", strings.Join(failed, ", "))
+	}
+	return nil
+}
+
+// ChrootInit is the re-executed side of RunInRoot: it chroots, drops capabilities
+// and privileges, then execs the command. It must be called first thing in main,
+// and returns only when the process isn't a chroot init.
+func ChrootInit() {
+	if len(os.Args) == 0 || os.Args[0] != chrootInitName {
+		return
+	}
+
+	runtime.LockOSThread()
+	if err := chrootInit(); err != nil {
+		fmt.Fprintln(os.Stderr, "artemide: chroot:", err)
+		os.Exit(127)
+	}
+}
+
+func chrootInit() error {
+	rootDir := os.Getenv(envChrootRoot)
+	user := os.Getenv(envChrootUser)
+	group := os.Getenv(envChrootGroup)
+
+	keep := map[uint]bool{}
+	for _, c := range strings.Split(os.Getenv(envChrootCaps), ",") {
+		if c == "" {
+			continue
+		}
+		n, err := strconv.ParseUint(c, 10, 32)
+		if err != nil {
+			return err
+		}
+		keep[uint(n)] = true
+	}
+
+	var env []string
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, "ARTEMIDE_CHROOT_") {
+			env = append(env, e)
+		}
+	}
+
+	if err := syscall.Chroot(rootDir); err != nil {
+		return fmt.Errorf("Failed to chroot to %s: %s", rootDir, err)
+	}
+	if err := os.Chdir("/"); err != nil {
+		return err
+	}
+
+	// Capabilities go first, setting the user would lose CAP_SETPCAP
+	if err := DropCapabilities(keep); err != nil {
+		return err
+	}
+	if user != "" || group != "" {
+		if err := setCredentials(user, group); err != nil {
+			return err
+		}
+	}
+
+	return Execv(os.Args[1], os.Args[1:], env)
+}
+
+// setCredentials switches to user and group, looked up in the chroot. The supplementary
+// groups go first, then the group, the user last: it takes the right to change them.
+func setCredentials(user string, group string) error {
+	c, err := LookupCredentials("/", user, group)
+	if err != nil {
+		return err
+	}
+	if err := unix.Setgroups(c.Groups); err != nil {
+		return fmt.Errorf("Failed to set the groups %v: %s", c.Groups, err)
+	}
+	if err := Setgid(c.Gid); err != nil {
+		return fmt.Errorf("Failed to set group %d: %s", c.Gid, err)
+	}
+	if user == "" {
+		return nil
+	}
+	if err := Setuid(c.Uid); err != nil {
+		return fmt.Errorf("Failed to set user %d: %s", c.Uid, err)
+	}
+	return nil
+}
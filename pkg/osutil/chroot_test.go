@@ -0,0 +1,200 @@
+package osutil
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// envTestIDs makes the test binary write its ids to the file it names and exit,
+// it is the command run in the chroot
+const envTestIDs = "ARTEMIDE_TEST_IDS"
+
+func TestMain(m *testing.M) {
+	ChrootInit()
+	if out := os.Getenv(envTestIDs); out != "" {
+		groups, _ := os.Getgroups()
+		sort.Ints(groups)
+		ids := fmt.Sprintf("%d %d %v", os.Getuid(), os.Getgid(), groups)
+		if err := ioutil.WriteFile(out, []byte(ids), 0644); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func TestRunInRootCredentials(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("chroot needs root")
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	root := writeUserDB(t)
+	defer os.RemoveAll(root)
+	if err := os.Chmod(root, 0755); err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(root, "out")
+	if err := os.Mkdir(out, 0777); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(out, 0777); err != nil {
+		t.Fatal(err)
+	}
+
+	// The test binary runs in the chroot, with the host libraries it is linked to
+	if err := os.Mkdir(filepath.Join(root, "test"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := Cp(exe, filepath.Join(root, "test", "osutil.test")); err != nil {
+		t.Fatal(err)
+	}
+	var robinds []string
+	for _, dir := range []string{"/lib", "/lib64", "/usr"} {
+		if ExistsDir(dir) {
+			robinds = append(robinds, dir)
+		}
+	}
+
+	for _, tc := range []struct {
+		user, group string
+		want        string
+	}{
+		{"builder", "", "1000 1000 [6 44 1000]"},
+		{"builder", "disk", "1000 6 [6 44]"},
+		{"", "video", "0 44 [44]"},
+		{"1234", "", "1234 1234 [1234]"},
+	} {
+		os.Remove(filepath.Join(out, "ids"))
+		err := RunInRoot(root, []string{"/test/osutil.test"}, RootOptions{
+			RoBinds:   robinds,
+			User:      tc.user,
+			Group:     tc.group,
+			Env:       []string{envTestIDs + "=/out/ids"},
+			LogPrefix: "test",
+		})
+		if err != nil {
+			t.Errorf("%q:%q: %s", tc.user, tc.group, err)
+			continue
+		}
+		ids, err := ioutil.ReadFile(filepath.Join(out, "ids"))
+		if err != nil {
+			t.Errorf("%q:%q: %s", tc.user, tc.group, err)
+			continue
+		}
+		if got := strings.TrimSpace(string(ids)); got != tc.want {
+			t.Errorf("%q:%q: got uid gid groups %s, want %s", tc.user, tc.group, got, tc.want)
+		}
+	}
+}
+
+func TestBindMountNotEmpty(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting needs root")
+	}
+	src, err := ioutil.TempDir("", "src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(src)
+	root, err := ioutil.TempDir("", "root")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	shipped := filepath.Join(root, "mnt", "shipped")
+	if err := os.MkdirAll(shipped, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := bindMount(src+":/mnt", root, false); err == nil {
+		UmountRoot(root)
+		t.Fatal("mounted over a non empty directory")
+	}
+	if !ExistsDir(shipped) {
+		t.Error("the content of the destination is hidden")
+	}
+
+	// /dev is a tmpfs of device nodes over the shipped one, which is back afterwards
+	if err := os.MkdirAll(filepath.Join(root, "dev", "shipped"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := GetMountsByRoot(root)
+	if err := mountSystem(root); err != nil {
+		t.Fatal(err)
+	}
+	if ExistsDir(filepath.Join(root, "dev", "shipped")) {
+		t.Error("/dev is not a fresh tmpfs")
+	}
+	for _, name := range []string{"null", "zero", "urandom", "tty"} {
+		if _, err := os.Stat(filepath.Join(root, "dev", name)); err != nil {
+			t.Error("no device node:", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "dev", "sda")); err == nil {
+		t.Error("the host block devices are in /dev")
+	}
+	if err := unmountNew(root, before); err != nil {
+		t.Fatal(err)
+	}
+	if !ExistsDir(filepath.Join(root, "dev", "shipped")) {
+		t.Error("the shipped /dev is gone")
+	}
+}
+
+func TestMountSymlinks(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("mounting needs root")
+	}
+	dir, err := ioutil.TempDir("", "symlinks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root, host, src := filepath.Join(dir, "root"), filepath.Join(dir, "host"), filepath.Join(dir, "src")
+	for _, d := range []string{root, host, src} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(host, filepath.Join(root, "proc")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(host, filepath.Join(root, "mnt")); err != nil {
+		t.Fatal(err)
+	}
+
+	before, _ := GetMountsByRoot(root)
+	if err := mountSystem(root); err == nil {
+		t.Error("mounted /proc thru a symlink")
+	}
+	if err := bindMount(src+":/mnt", root, false); err == nil {
+		t.Error("bind mounted thru a symlink")
+	}
+	// The parents resolve in the root
+	if err := bindMount(src+":/mnt/data", root, true); err != nil {
+		t.Error(err)
+	}
+	mounts, _ := GetMountsByRoot(dir)
+	unmountNew(root, before)
+	for _, m := range mounts {
+		if !strings.HasPrefix(m, root+"/") {
+			t.Errorf("%s mounted out of the root", m)
+		}
+	}
+	if len(mounts) == 0 || mounts[len(mounts)-1] != filepath.Join(root, host, "data") {
+		t.Errorf("mounts are %v, want %s last", mounts, filepath.Join(root, host, "data"))
+	}
+	if names, _ := ioutil.ReadDir(host); len(names) > 0 {
+		t.Errorf("created %s in the host directory", names[0].Name())
+	}
+}
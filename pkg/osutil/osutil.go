@@ -21,6 +21,8 @@ import (
 	log "github.com/spf13/jwalterweatherman"
 	"github.com/yuuki1/go-group"
 	"golang.org/x/sys/unix"
+
+	"github.com/mudler/artemide/pkg/layer"
 )
 
 const (
@@ -34,6 +36,14 @@ func Setgid(id int) error {
 func Setuid(id int) error {
 	return system.Setuid(id)
 }
+
+// BindMount mounts the host directory bindDir, given as "src[:dest]", in rootDir.
+// The destination must be an empty directory, the content of the root is never hidden,
+// and resolves in rootDir: the symlinks of the root never lead the mount to the host.
+func BindMount(bindDir string, rootDir string, readonly bool) error {
+	return bindMount(bindDir, rootDir, readonly)
+}
+
 func bindMount(bindDir string, rootDir string, readonly bool) error {
 	var srcDir, destDir string
 
@@ -52,27 +62,32 @@ func bindMount(bindDir string, rootDir string, readonly bool) error {
 		return err
 	}
 
-	containerDir := fp.Join(rootDir, destDir)
+	containerDir, err := RootPath(rootDir, destDir)
+	if err != nil {
+		return err
+	}
 
 	if err := fileutils.CreateIfNotExists(containerDir, true); err != nil { // mkdir -p
-		log.FATAL.Fatalln("Failed to create directory:", containerDir, err)
+		return fmt.Errorf("Failed to create directory %s: %s", containerDir, err)
 	}
 
 	ok, err = IsDirEmpty(containerDir)
 	if err != nil {
 		return err
 	}
-	if ok {
-		log.DEBUG.Println("bind mount", bindDir, "to", containerDir)
-		if err := mount.Mount(srcDir, containerDir, "none", "bind,rw"); err != nil {
-			log.FATAL.Fatalln("Failed to bind mount:", containerDir, err)
-		}
+	if !ok {
+		return fmt.Errorf("Failed to bind mount %s: %s is not an empty directory", srcDir, containerDir)
+	}
 
-		if readonly {
-			log.DEBUG.Println("robind mount", bindDir, "to", containerDir)
-			if err := mount.Mount(srcDir, containerDir, "none", "remount,ro,bind"); err != nil {
-				log.FATAL.Fatalln("Failed to robind mount:", containerDir, err)
-			}
+	log.DEBUG.Println("bind mount", bindDir, "to", containerDir)
+	if err := mount.Mount(srcDir, containerDir, "none", "bind,rw"); err != nil {
+		return fmt.Errorf("Failed to bind mount %s: %s", containerDir, err)
+	}
+
+	if readonly {
+		log.DEBUG.Println("robind mount", bindDir, "to", containerDir)
+		if err := mount.Mount(srcDir, containerDir, "none", "remount,ro,bind"); err != nil {
+			return fmt.Errorf("Failed to robind mount %s: %s", containerDir, err)
 		}
 	}
 
@@ -124,6 +139,12 @@ func Cp(from, to string) error {
 	return nil
 }
 
+// CopyTree copies the content of the from directory in to, preserving links, ownership,
+// permissions and times. Files are reflinked on the filesystems supporting it.
+func CopyTree(from, to string) error {
+	return RunCmd("cp", "-a", "--reflink=auto", strings.TrimSuffix(from, "/")+"/.", to)
+}
+
 // Mknod unless path does not exists.
 func Mknod(path string, mode uint32, dev int) error {
 	if ExistsFile(path) {
@@ -157,39 +178,84 @@ func Execv(cmd string, args []string, env []string) error {
 	return syscall.Exec(name, args, env)
 }
 
-func createDevices(rootDir string, uid, gid int) error {
-	nullDir := fp.Join(rootDir, os.DevNull)
-	if err := Mknod(nullDir, syscall.S_IFCHR|uint32(os.FileMode(0666)), 1*256+3); err != nil {
-		return err
-	}
+// devices are the nodes createDevices makes in /dev
+var devices = []struct {
+	name         string
+	major, minor int
+}{
+	{"null", 1, 3},
+	{"zero", 1, 5},
+	{"full", 1, 7},
+	{"random", 1, 8},
+	{"urandom", 1, 9},
+	{"tty", 5, 0},
+}
 
-	if err := os.Lchown(nullDir, uid, gid); err != nil {
-		log.FATAL.Fatalln("Failed to lchown:", nullDir, err)
-	}
+// devLinks are the symlinks createDevices makes in /dev, to their target
+var devLinks = [][2]string{
+	{"fd", "/proc/self/fd"},
+	{"stdin", "/proc/self/fd/0"},
+	{"stdout", "/proc/self/fd/1"},
+	{"stderr", "/proc/self/fd/2"},
+	{"ptmx", "pts/ptmx"},
+}
 
-	zeroDir := fp.Join(rootDir, "/dev/zero")
-	if err := Mknod(zeroDir, syscall.S_IFCHR|uint32(os.FileMode(0666)), 1*256+3); err != nil {
+func createDevices(rootDir string, uid, gid int) error {
+	dev, err := RootPath(rootDir, "/dev")
+	if err != nil {
 		return err
 	}
-
-	if err := os.Lchown(zeroDir, uid, gid); err != nil {
-		log.FATAL.Fatalln("Failed to lchown:", zeroDir, err)
+	for _, dir := range []string{dev, fp.Join(dev, "pts"), fp.Join(dev, "shm")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
 	}
 
-	for _, f := range []string{"/dev/random", "/dev/urandom"} {
-		randomDir := fp.Join(rootDir, f)
-		if err := Mknod(randomDir, syscall.S_IFCHR|uint32(os.FileMode(0666)), 1*256+9); err != nil {
+	for _, d := range devices {
+		// Made in place when /dev is not a tmpfs: a shipped symlink must not lead to the host
+		path, err := RootPath(rootDir, fp.Join("/dev", d.name))
+		if err != nil {
 			return err
 		}
-
-		if err := os.Lchown(randomDir, uid, gid); err != nil {
-			log.FATAL.Fatalln("Failed to lchown:", randomDir, err)
+		if err := Mknod(path, syscall.S_IFCHR|uint32(os.FileMode(0666)), d.major*256+d.minor); err != nil {
+			return fmt.Errorf("Failed to create %s: %s", path, err)
+		}
+		// The umask took its share
+		if err := os.Chmod(path, 0666); err != nil {
+			return err
+		}
+		if err := os.Lchown(path, uid, gid); err != nil {
+			return fmt.Errorf("Failed to lchown %s: %s", path, err)
 		}
 	}
 
+	for _, l := range devLinks {
+		if err := Symlink(l[1], fp.Join(dev, l[0])); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// RootPath returns where path is in rootDir, the symlinks of its parents resolved in
+// rootDir like layer.SecureJoin does. The last component is never followed: the caller
+// mounts or creates it, so a symlink there is refused, and so is the root itself.
+func RootPath(rootDir string, path string) (string, error) {
+	clean := fp.Clean("/" + path)
+	if clean == "/" {
+		return "", fmt.Errorf("%s is the root of %s", path, rootDir)
+	}
+	parent, err := layer.SecureJoin(rootDir, fp.Dir(clean))
+	if err != nil {
+		return "", err
+	}
+	target := fp.Join(parent, fp.Base(clean))
+	if fi, err := os.Lstat(target); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+		return "", fmt.Errorf("%s is a symlink in %s", path, rootDir)
+	}
+	return target, nil
+}
+
 // Unmount will unmount the target filesystem, so long as it is mounted.
 func Unmount(target string, flag int) error {
 	if mounted, err := Mounted(target); err != nil || !mounted {
@@ -237,7 +303,7 @@ func GetMountsByRoot(rootDir string) ([]string, error) {
 
 	s := bufio.NewScanner(f)
 	mountpoints := make([]string, 0)
-	re := regexp.MustCompile(fmt.Sprintf("^%s", rootDir))
+	re := regexp.MustCompile(fmt.Sprintf("^%s", regexp.QuoteMeta(rootDir)))
 
 	for s.Scan() {
 		if err := s.Err(); err != nil {
@@ -271,9 +337,10 @@ func UmountRoot(rootDir string) (err error) {
 		return err
 	}
 
-	for _, mount := range mounts {
-		if err = Unmount(mount, syscall.MNT_DETACH|syscall.MNT_FORCE); err == nil {
-			log.DEBUG.Println("umount:", mount)
+	// Innermost first, the outer mounts would take them away
+	for i := len(mounts) - 1; i >= 0; i-- {
+		if err = ForceUnmount(mounts[i], syscall.MNT_DETACH|syscall.MNT_FORCE); err == nil {
+			log.DEBUG.Println("umount:", mounts[i])
 		}
 	}
 	return
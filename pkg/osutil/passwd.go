@@ -0,0 +1,150 @@
+package osutil
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	fp "path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Credentials are the ids a command runs with
+type Credentials struct {
+	Uid    int
+	Gid    int
+	Groups []int // supplementary groups, the primary one included
+}
+
+// LookupCredentials resolves user and group, names or ids, from the /etc/passwd and
+// /etc/group of root. The group defaults to the primary group of the user, and the
+// supplementary groups are the ones listing the user. A numeric user missing from
+// /etc/passwd gets the group of the same id.
+func LookupCredentials(root string, user string, group string) (*Credentials, error) {
+	c := &Credentials{}
+	name := ""
+
+	if user != "" {
+		entry, err := findEntry(fp.Join(root, "etc", "passwd"), user, 2)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case entry != nil && len(entry) >= 4:
+			name = entry[0]
+			if c.Uid, err = strconv.Atoi(entry[2]); err != nil {
+				return nil, fmt.Errorf("invalid uid %q of user %s", entry[2], name)
+			}
+			if c.Gid, err = strconv.Atoi(entry[3]); err != nil {
+				return nil, fmt.Errorf("invalid gid %q of user %s", entry[3], name)
+			}
+		case isID(user):
+			c.Uid, _ = strconv.Atoi(user)
+			c.Gid = c.Uid
+		default:
+			return nil, fmt.Errorf("unknown user %s", user)
+		}
+	}
+
+	groups, err := readEntries(fp.Join(root, "etc", "group"))
+	if err != nil {
+		return nil, err
+	}
+	if group != "" {
+		entry := lookupEntry(groups, group, 2)
+		switch {
+		case entry != nil && len(entry) >= 3:
+			if c.Gid, err = strconv.Atoi(entry[2]); err != nil {
+				return nil, fmt.Errorf("invalid gid %q of group %s", entry[2], entry[0])
+			}
+		case isID(group):
+			c.Gid, _ = strconv.Atoi(group)
+		default:
+			return nil, fmt.Errorf("unknown group %s", group)
+		}
+	}
+
+	c.Groups = []int{c.Gid}
+	if name == "" {
+		return c, nil
+	}
+	for _, entry := range groups {
+		if len(entry) < 4 || !contains(strings.Split(entry[3], ","), name) {
+			continue
+		}
+		gid, err := strconv.Atoi(entry[2])
+		if err != nil || containsInt(c.Groups, gid) {
+			continue
+		}
+		c.Groups = append(c.Groups, gid)
+	}
+	return c, nil
+}
+
+// findEntry returns the entry of a colon separated database file named, or numbered at field idField, id.
+// A missing file has no entries.
+func findEntry(file string, id string, idField int) ([]string, error) {
+	entries, err := readEntries(file)
+	if err != nil {
+		return nil, err
+	}
+	return lookupEntry(entries, id, idField), nil
+}
+
+func lookupEntry(entries [][]string, id string, idField int) []string {
+	field := 0
+	if isID(id) {
+		field = idField
+	}
+	for _, entry := range entries {
+		if len(entry) > field && entry[field] == id {
+			return entry
+		}
+	}
+	return nil
+}
+
+func readEntries(file string) ([][]string, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries [][]string
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, strings.Split(line, ":"))
+	}
+	return entries, s.Err()
+}
+
+func isID(s string) bool {
+	_, err := strconv.Atoi(s)
+	return err == nil
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsInt(list []int, n int) bool {
+	for _, e := range list {
+		if e == n {
+			return true
+		}
+	}
+	return false
+}
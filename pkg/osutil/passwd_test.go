@@ -0,0 +1,80 @@
+package osutil
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testPasswd = `root:x:0:0:root:/root:/bin/sh
+# comment
+builder:x:1000:1000::/home/builder:/bin/sh
+nobody:x:65534:65534::/:/sbin/nologin
+`
+
+const testGroup = `root:x:0:
+disk:x:6:builder
+video:x:44:other,builder
+builder:x:1000:
+nogroup:x:65534:
+`
+
+func writeUserDB(t *testing.T) string {
+	root, err := ioutil.TempDir("", "passwd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(root, "etc"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"passwd": testPasswd, "group": testGroup} {
+		if err := ioutil.WriteFile(filepath.Join(root, "etc", name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func TestLookupCredentials(t *testing.T) {
+	root := writeUserDB(t)
+	defer os.RemoveAll(root)
+
+	for _, tc := range []struct {
+		user, group string
+		want        Credentials
+	}{
+		{"builder", "", Credentials{1000, 1000, []int{1000, 6, 44}}},
+		{"1000", "", Credentials{1000, 1000, []int{1000, 6, 44}}},
+		{"builder", "disk", Credentials{1000, 6, []int{6, 44}}},
+		{"builder", "50", Credentials{1000, 50, []int{50, 6, 44}}},
+		{"nobody", "", Credentials{65534, 65534, []int{65534}}},
+		{"", "video", Credentials{0, 44, []int{44}}},
+		{"1234", "", Credentials{1234, 1234, []int{1234}}},
+		{"root", "", Credentials{0, 0, []int{0}}},
+	} {
+		got, err := LookupCredentials(root, tc.user, tc.group)
+		if err != nil {
+			t.Errorf("%q:%q: %s", tc.user, tc.group, err)
+			continue
+		}
+		if !reflect.DeepEqual(*got, tc.want) {
+			t.Errorf("%q:%q: got %+v, want %+v", tc.user, tc.group, *got, tc.want)
+		}
+	}
+}
+
+func TestLookupCredentialsUnknown(t *testing.T) {
+	root := writeUserDB(t)
+	defer os.RemoveAll(root)
+
+	for _, tc := range []struct{ user, group string }{
+		{"missing", ""},
+		{"builder", "missing"},
+	} {
+		if _, err := LookupCredentials(root, tc.user, tc.group); err == nil {
+			t.Errorf("%q:%q: no error", tc.user, tc.group)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package osutil
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	stdlog "log"
+	"os/exec"
+	"sync"
+	"syscall"
+	"time"
+
+	log "github.com/spf13/jwalterweatherman"
+)
+
+// outputDelay is how long the output is still read once the command exited, a background
+// child keeping it open is not waited for longer
+var outputDelay = 5 * time.Second
+
+// maxLine is the longest line logged at once, longer ones are split
+const maxLine = 64 * 1024
+
+// RunStreamed runs cmd logging its stdout and stderr line by line, prefixed with prefix.
+// The command and its children are killed if it doesn't terminate within timeout (0 disables it),
+// or when cancel is closed (it can be nil).
+func RunStreamed(cmd *exec.Cmd, prefix string, timeout time.Duration, cancel <-chan struct{}) error {
+	// Not the StdoutPipe ones: with writers, Wait gives up on the output after WaitDelay
+	stdout, stdoutW := io.Pipe()
+	stderr, stderrW := io.Pipe()
+	cmd.Stdout, cmd.Stderr = stdoutW, stderrW
+	cmd.WaitDelay = outputDelay
+
+	// own process group, so a timeout takes down whatever the command spawned
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.Setpgid = true
+
+	log.DEBUG.Println("runstreamed: ", cmd.Path, cmd.Args)
+	if err := cmd.Start(); err != nil {
+		stdout.Close()
+		stderr.Close()
+		return err
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go logLines(&wg, stdout, log.INFO, prefix)
+	go logLines(&wg, stderr, log.WARN, prefix)
+
+	done := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		stdoutW.Close()
+		stderrW.Close()
+		wg.Wait()
+		done <- err
+	}()
+
+	var err error
+	var expired <-chan time.Time
+	if timeout > 0 {
+		expired = time.After(timeout)
+	}
+
+	select {
+	case err = <-done:
+	case <-expired:
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return fmt.Errorf("%s timed out after %s", cmd.Path, timeout)
+	case <-cancel:
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+		<-done
+		return fmt.Errorf("%s interrupted", cmd.Path)
+	}
+
+	if err == exec.ErrWaitDelay {
+		log.WARN.Println(prefix, "a background process kept the output open, it is no longer logged")
+		return nil
+	}
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+				return fmt.Errorf("%s exited with status %d", cmd.Path, status.ExitStatus())
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+func logLines(wg *sync.WaitGroup, r io.Reader, logger *stdlog.Logger, prefix string) {
+	defer wg.Done()
+	reader := bufio.NewReaderSize(r, maxLine)
+	for {
+		line, err := reader.ReadSlice('\n')
+		if len(line) > 0 {
+			logger.Println(prefix, string(bytes.TrimSuffix(line, []byte("\n"))))
+		}
+		switch err {
+		case nil, bufio.ErrBufferFull:
+			continue
+		case io.EOF:
+			return
+		}
+		// Drained anyway, the command would block writing
+		log.ERROR.Println(prefix, "reading the output:", err)
+		io.Copy(ioutil.Discard, reader)
+		return
+	}
+}
@@ -0,0 +1,44 @@
+package osutil
+
+import (
+	"bytes"
+	stdlog "log"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRunStreamedLongLine(t *testing.T) {
+	// Far more than a pipe holds, on a single line
+	cmd := exec.Command("sh", "-c", "head -c 1000000 /dev/zero | tr '\\0' x; echo; echo done")
+	if err := RunStreamed(cmd, "[test]", 10*time.Second, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	var wg sync.WaitGroup
+	wg.Add(1)
+	logLines(&wg, strings.NewReader(strings.Repeat("x", 1000000)+"\ndone\n"), stdlog.New(&buf, "", 0), "[test]")
+	if got := strings.Count(buf.String(), "x"); got != 1000000 {
+		t.Errorf("logged %d of the 1000000 characters", got)
+	}
+	if !strings.Contains(buf.String(), "[test] done") {
+		t.Error("the lines after the long one are not logged")
+	}
+}
+
+func TestRunStreamedBackgroundChild(t *testing.T) {
+	defer func(d time.Duration) { outputDelay = d }(outputDelay)
+	outputDelay = 100 * time.Millisecond
+
+	start := time.Now()
+	cmd := exec.Command("sh", "-c", "sleep 5 & echo started")
+	if err := RunStreamed(cmd, "[test]", 10*time.Second, nil); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("waited %s for the background child", elapsed)
+	}
+}
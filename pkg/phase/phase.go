@@ -0,0 +1,43 @@
+// Package phase defines the ordered lifecycle every artifact goes thru during a build
+package phase
+
+// Lifecycle phases, recipe events are named after them
+const (
+	BeforeUnpack  = "before_unpack"
+	AfterUnpack   = "after_unpack"
+	PreChroot     = "pre_chroot"
+	InsideChroot  = "inside_chroot"
+	PostChroot    = "post_chroot"
+	BeforePackage = "before_package"
+	AfterPackage  = "after_package"
+	AfterChecksum = "after_checksum"
+	Finish        = "finish"
+)
+
+// All lists the phases in the order they are emitted
+var All = []string{
+	BeforeUnpack,
+	AfterUnpack,
+	PreChroot,
+	InsideChroot,
+	PostChroot,
+	BeforePackage,
+	AfterPackage,
+	AfterChecksum,
+	Finish,
+}
+
+// Index returns the position of the phase in the lifecycle, -1 if unknown
+func Index(name string) int {
+	for i, p := range All {
+		if p == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Valid tells if name is a known phase
+func Valid(name string) bool {
+	return Index(name) != -1
+}
@@ -0,0 +1,179 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	log "github.com/spf13/jwalterweatherman"
+)
+
+// DockerHubServer is the key of the docker hub credentials in the docker configuration
+const DockerHubServer = "https://index.docker.io/v1/"
+
+// DockerConfig is the part of the docker client configuration holding the credentials
+type DockerConfig struct {
+	Auths       map[string]dockerAuth `json:"auths"`
+	CredHelpers map[string]string     `json:"credHelpers"` // helper by registry host
+	CredsStore  string                `json:"credsStore"`  // helper for all the other registries
+}
+
+type dockerAuth struct {
+	Auth     string `json:"auth"` // base64 of "username:password"
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// DockerConfigPath is the configuration the docker client uses: in $DOCKER_CONFIG, or in ~/.docker
+func DockerConfigPath() string {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json")
+	}
+	return filepath.Join(os.Getenv("HOME"), ".docker", "config.json")
+}
+
+// LoadDockerConfig reads the docker client configuration, a missing file has no credentials
+func LoadDockerConfig(path string) (*DockerConfig, error) {
+	config := &DockerConfig{}
+	body, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(body, config); err != nil {
+		return nil, fmt.Errorf("%s: %s", path, err)
+	}
+	return config, nil
+}
+
+// Lookup returns the credentials of the registry host: from its credential helper, or the
+// credentials store, falling back to the auths entries. They are empty when none is found,
+// a helper which is not installed has none.
+func (c *DockerConfig) Lookup(host string) (Credentials, error) {
+	host = normalizeHost(host)
+
+	helper := c.CredHelpers[host]
+	if helper == "" && host == normalizeHost(DockerHubServer) {
+		helper = c.CredHelpers["docker.io"]
+	}
+	if helper == "" {
+		helper = c.CredsStore
+	}
+	if helper != "" {
+		creds, found, err := helperGet(helper, serverAddress(host))
+		if err != nil {
+			return Credentials{}, err
+		}
+		if found {
+			log.DEBUG.Println("Credentials of", host, "from docker-credential-"+helper)
+			return creds, nil
+		}
+	}
+
+	for server, auth := range c.Auths {
+		if normalizeHost(server) != host {
+			continue
+		}
+		if auth.Auth == "" {
+			return Credentials{Username: auth.Username, Password: auth.Password}, nil
+		}
+		decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			return Credentials{}, fmt.Errorf("invalid auth of %s: %s", server, err)
+		}
+		parts := strings.SplitN(string(decoded), ":", 2)
+		if len(parts) != 2 {
+			return Credentials{}, fmt.Errorf("invalid auth of %s", server)
+		}
+		log.DEBUG.Println("Credentials of", host, "from the docker configuration")
+		return Credentials{Username: parts[0], Password: parts[1]}, nil
+	}
+	return Credentials{}, nil
+}
+
+// ResolveCredentials returns the credentials of the registry host: the explicit ones when
+// username is given, with the password read from the passwordEnv environment variable,
+// those of the docker configuration otherwise.
+func ResolveCredentials(host string, username string, passwordEnv string) (Credentials, error) {
+	if username != "" {
+		password := os.Getenv(passwordEnv)
+		if password == "" {
+			return Credentials{}, fmt.Errorf("no password for %s: %s is not set", username, passwordEnv)
+		}
+		return Credentials{Username: username, Password: password}, nil
+	}
+
+	config, err := LoadDockerConfig(DockerConfigPath())
+	if err != nil {
+		return Credentials{}, err
+	}
+	return config.Lookup(host)
+}
+
+// ServerAddress is how docker names the registry host in its configuration and auth requests
+func ServerAddress(host string) string {
+	return serverAddress(normalizeHost(host))
+}
+
+func serverAddress(host string) string {
+	if host == normalizeHost(DockerHubServer) {
+		return DockerHubServer
+	}
+	return host
+}
+
+// normalizeHost strips the scheme and path of the configuration keys, and
+// names the docker hub the same way whatever alias is used
+func normalizeHost(server string) string {
+	host := server
+	if i := strings.Index(host, "://"); i != -1 {
+		host = host[i+3:]
+	}
+	if i := strings.Index(host, "/"); i != -1 {
+		host = host[:i]
+	}
+	switch host {
+	case "docker.io", "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		return "index.docker.io"
+	}
+	return host
+}
+
+// helperGet asks the docker-credential-<helper> executable for the credentials of server
+func helperGet(helper string, server string) (Credentials, bool, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(server)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		// A configuration copied from another machine may name a helper not installed here
+		if execErr, ok := err.(*exec.Error); ok && execErr.Err == exec.ErrNotFound {
+			log.WARN.Printf("docker-credential-%s is not installed, no credentials from it for %s\n", helper, server)
+			return Credentials{}, false, nil
+		}
+		out := strings.TrimSpace(stdout.String() + stderr.String())
+		if strings.Contains(out, "credentials not found") {
+			return Credentials{}, false, nil
+		}
+		return Credentials{}, false, fmt.Errorf("docker-credential-%s: %s: %s", helper, err, out)
+	}
+
+	var reply struct {
+		Username string
+		Secret   string
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &reply); err != nil {
+		return Credentials{}, false, fmt.Errorf("docker-credential-%s: invalid reply: %s", helper, err)
+	}
+	return Credentials{Username: reply.Username, Password: reply.Secret}, true, nil
+}
@@ -0,0 +1,31 @@
+package registry
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestLookupMissingHelper(t *testing.T) {
+	config := &DockerConfig{
+		CredsStore: "artemide-test-missing",
+		Auths: map[string]dockerAuth{
+			"private.example.com": {Auth: base64.StdEncoding.EncodeToString([]byte("builder:secret"))},
+		},
+	}
+
+	creds, err := config.Lookup("registry-1.docker.io")
+	if err != nil {
+		t.Fatalf("a missing helper fails the anonymous pulls: %s", err)
+	}
+	if creds != (Credentials{}) {
+		t.Errorf("got %+v, want no credentials", creds)
+	}
+
+	creds, err = config.Lookup("private.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (Credentials{Username: "builder", Password: "secret"}); creds != want {
+		t.Errorf("got %+v, want the auths entry %+v", creds, want)
+	}
+}
@@ -0,0 +1,143 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+
+	log "github.com/spf13/jwalterweatherman"
+
+	"github.com/mudler/artemide/pkg/image"
+	"github.com/mudler/artemide/pkg/layer"
+)
+
+// Resolve returns the image manifest of ref and its digest. For manifest lists and
+// image indexes, the manifest of the client platform is picked; a single manifest is
+// checked against the platform, when one was given.
+func (c *Client) Resolve(ref Reference) (image.Manifest, string, error) {
+	var manifest image.Manifest
+
+	platform := c.Platform
+	if platform.OS == "" {
+		platform = image.HostPlatform()
+	}
+
+	body, mediaType, digest, err := c.Manifest(ref, ref.Object())
+	if err != nil {
+		return manifest, "", err
+	}
+
+	isIndex := image.IsIndex(mediaType)
+	if isIndex {
+		var index image.Index
+		if err := json.Unmarshal(body, &index); err != nil {
+			return manifest, "", fmt.Errorf("invalid index %s: %s", ref, err)
+		}
+		selected, ok := index.ForPlatform(platform)
+		if !ok {
+			return manifest, "", fmt.Errorf("%s has no manifest for %s (available: %s)", ref, platform, strings.Join(index.Platforms(), ", "))
+		}
+		log.INFO.Printf("Selected the %s manifest of %s\n", selected.Platform, ref)
+		if body, mediaType, digest, err = c.Manifest(ref, selected.Digest); err != nil {
+			return manifest, "", err
+		}
+	}
+
+	if !image.IsManifest(mediaType) {
+		return manifest, "", fmt.Errorf("%s: unsupported manifest type %q", ref, mediaType)
+	}
+	if err := json.Unmarshal(body, &manifest); err != nil {
+		return manifest, "", fmt.Errorf("invalid manifest %s: %s", ref, err)
+	}
+
+	if !isIndex && c.Platform.OS != "" {
+		config, err := c.Config(ref, manifest.Config)
+		if err != nil {
+			return manifest, "", err
+		}
+		if !c.Platform.Matches(config.Platform()) {
+			return manifest, "", fmt.Errorf("%s is built for %s, not %s", ref, config.Platform(), c.Platform)
+		}
+	}
+	return manifest, digest, nil
+}
+
+// Config fetches the image configuration
+func (c *Client) Config(ref Reference, desc image.Descriptor) (image.Config, error) {
+	var config image.Config
+
+	blob, err := c.Blob(ref, desc.Digest)
+	if err != nil {
+		return config, err
+	}
+	defer blob.Close()
+
+	body, err := ioutil.ReadAll(blob)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(body, &config); err != nil {
+		return config, fmt.Errorf("invalid image config %s: %s", desc.Digest, err)
+	}
+	return config, nil
+}
+
+// Unpack pulls the image and applies its layers, in order, on dest.
+// It returns the digest of the unpacked manifest.
+func (c *Client) Unpack(ref Reference, dest string) (string, error) {
+	manifest, digest, err := c.Resolve(ref)
+	if err != nil {
+		return "", err
+	}
+	log.INFO.Printf("Pulling %s (%s), %d layers\n", ref, digest, len(manifest.Layers))
+
+	return digest, c.Apply(ref, manifest, dest)
+}
+
+// Apply pulls the layers of a resolved manifest and applies them, in order, on dest
+func (c *Client) Apply(ref Reference, manifest image.Manifest, dest string) error {
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+
+	for i, desc := range manifest.Layers {
+		log.INFO.Printf("Layer %d/%d %s (%d bytes)\n", i+1, len(manifest.Layers), desc.Digest, desc.Size)
+		if err := c.applyLayer(ref, desc, dest); err != nil {
+			return fmt.Errorf("layer %s: %s", desc.Digest, err)
+		}
+	}
+	return nil
+}
+
+// applyLayer downloads the layer before applying it, so nothing unverified lands in dest
+func (c *Client) applyLayer(ref Reference, desc image.Descriptor, dest string) error {
+	blob, err := c.Blob(ref, desc.Digest)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	tmp, err := ioutil.TempFile("", "artemide-layer")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, blob); err != nil {
+		return err
+	}
+	if _, err := tmp.Seek(0, 0); err != nil {
+		return err
+	}
+
+	stats, err := layer.Apply(tmp, dest, layer.Options{})
+	if err != nil {
+		return err
+	}
+	log.DEBUG.Printf("Applied %d entries, %d bytes\n", stats.Files, stats.Bytes)
+	return nil
+}
@@ -0,0 +1,79 @@
+package registry
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DefaultRegistry is where the images without a registry host come from
+const DefaultRegistry = "registry-1.docker.io"
+
+// Reference is a parsed image name: [registry/]repository[:tag][@digest]
+type Reference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// ParseReference parses an image name the way docker does: images without a registry
+// come from the docker hub, and official ones are under library/
+func ParseReference(name string) (Reference, error) {
+	var ref Reference
+	if name == "" {
+		return ref, fmt.Errorf("empty image name")
+	}
+
+	if i := strings.Index(name, "@"); i != -1 {
+		ref.Digest = name[i+1:]
+		name = name[:i]
+	}
+
+	// A tag is after the last colon, unless it is the port of the registry
+	if i := strings.LastIndex(name, ":"); i != -1 && !strings.Contains(name[i:], "/") {
+		ref.Tag = name[i+1:]
+		name = name[:i]
+	}
+
+	parts := strings.SplitN(name, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		ref.Registry = parts[0]
+		ref.Repository = parts[1]
+	} else {
+		ref.Registry = DefaultRegistry
+		ref.Repository = name
+	}
+	if ref.Registry == "docker.io" || ref.Registry == "index.docker.io" {
+		ref.Registry = DefaultRegistry
+	}
+	if ref.Registry == DefaultRegistry && !strings.Contains(ref.Repository, "/") {
+		ref.Repository = "library/" + ref.Repository
+	}
+
+	if ref.Repository == "" || strings.ToLower(ref.Repository) != ref.Repository {
+		return ref, fmt.Errorf("invalid repository name in %q", name)
+	}
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = "latest"
+	}
+	return ref, nil
+}
+
+// Object returns what to ask the registry for: the digest when known, the tag otherwise
+func (r Reference) Object() string {
+	if r.Digest != "" {
+		return r.Digest
+	}
+	return r.Tag
+}
+
+func (r Reference) String() string {
+	s := r.Registry + "/" + r.Repository
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
@@ -0,0 +1,270 @@
+// Package registry pulls images from a docker registry thru its HTTP API v2, without a docker daemon
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	log "github.com/spf13/jwalterweatherman"
+
+	"github.com/mudler/artemide/pkg/image"
+)
+
+// manifestAccept lists the manifests we can handle, in order of preference
+var manifestAccept = []string{
+	image.MediaTypeOCIIndex,
+	image.MediaTypeDockerManifestList,
+	image.MediaTypeOCIManifest,
+	image.MediaTypeDockerManifest,
+}
+
+// Credentials authenticate against a registry, anonymous when empty
+type Credentials struct {
+	Username string
+	Password string
+}
+
+// Client talks to docker registries
+type Client struct {
+	HTTPClient  *http.Client
+	PlainHTTP   bool           // use http instead of https, for local registries
+	Credentials Credentials    // used for basic auth and to get tokens
+	Platform    image.Platform // picked from manifest lists, the host one when empty
+
+	mu     sync.Mutex
+	tokens map[string]string // bearer tokens by registry and scope
+}
+
+// NewClient returns a Client using the default HTTP client
+func NewClient() *Client {
+	return &Client{
+		HTTPClient: http.DefaultClient,
+		tokens:     map[string]string{},
+	}
+}
+
+func (c *Client) url(ref Reference, path string) string {
+	scheme := "https"
+	if c.PlainHTTP {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s/v2/%s/%s", scheme, ref.Registry, ref.Repository, path)
+}
+
+// Manifest fetches a manifest or an index. It returns its content, media type and digest,
+// the digest is verified when the object is asked by digest.
+func (c *Client) Manifest(ref Reference, object string) ([]byte, string, string, error) {
+	// Tags have no colon, anything else is a digest and must be one we can verify
+	byDigest := strings.Contains(object, ":")
+	if byDigest {
+		if err := image.ValidateDigest(object); err != nil {
+			return nil, "", "", err
+		}
+	}
+
+	req, err := http.NewRequest("GET", c.url(ref, "manifests/"+object), nil)
+	if err != nil {
+		return nil, "", "", err
+	}
+	req.Header.Set("Accept", strings.Join(manifestAccept, ", "))
+
+	res, err := c.do(ref, req)
+	if err != nil {
+		return nil, "", "", err
+	}
+	defer res.Body.Close()
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, "", "", err
+	}
+
+	digest := image.FromBytes(body)
+	if byDigest && digest != object {
+		return nil, "", "", fmt.Errorf("manifest digest mismatch: expected %s, got %s", object, digest)
+	}
+
+	mediaType := res.Header.Get("Content-Type")
+	if i := strings.Index(mediaType, ";"); i != -1 {
+		mediaType = mediaType[:i]
+	}
+	// Some registries are vague on the content type, the manifest knows better
+	var probe struct {
+		MediaType string `json:"mediaType"`
+	}
+	if json.Unmarshal(body, &probe) == nil && probe.MediaType != "" {
+		mediaType = probe.MediaType
+	}
+
+	return body, mediaType, digest, nil
+}
+
+// Blob fetches a blob, reading it fails at EOF if its content doesn't match the digest
+func (c *Client) Blob(ref Reference, digest string) (io.ReadCloser, error) {
+	if err := image.ValidateDigest(digest); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("GET", c.url(ref, "blobs/"+digest), nil)
+	if err != nil {
+		return nil, err
+	}
+	res, err := c.do(ref, req)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{image.NewVerifyingReader(res.Body, digest), res.Body}, nil
+}
+
+// do sends the request, authenticating when the registry challenges it
+func (c *Client) do(ref Reference, req *http.Request) (*http.Response, error) {
+	scope := "repository:" + ref.Repository + ":pull"
+	key := ref.Registry + " " + scope
+
+	c.mu.Lock()
+	token := c.tokens[key]
+	c.mu.Unlock()
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if res.StatusCode == http.StatusUnauthorized {
+		challenge := res.Header.Get("WWW-Authenticate")
+		res.Body.Close()
+
+		scheme, params := parseChallenge(challenge)
+		switch strings.ToLower(scheme) {
+		case "bearer":
+			if params["scope"] == "" {
+				params["scope"] = scope
+			}
+			token, err := c.token(params)
+			if err != nil {
+				return nil, fmt.Errorf("authenticating to %s: %s", ref.Registry, err)
+			}
+			c.mu.Lock()
+			c.tokens[key] = token
+			c.mu.Unlock()
+			req.Header.Set("Authorization", "Bearer "+token)
+		case "basic":
+			if c.Credentials.Username == "" {
+				return nil, fmt.Errorf("%s requires credentials", ref.Registry)
+			}
+			req.SetBasicAuth(c.Credentials.Username, c.Credentials.Password)
+		default:
+			return nil, fmt.Errorf("unsupported authentication challenge %q from %s", challenge, ref.Registry)
+		}
+
+		if res, err = c.HTTPClient.Do(req); err != nil {
+			return nil, err
+		}
+	}
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 1024))
+		res.Body.Close()
+		return nil, fmt.Errorf("GET %s: %s: %s", req.URL, res.Status, strings.TrimSpace(string(body)))
+	}
+	return res, nil
+}
+
+// token asks the authorization service of a bearer challenge for a token
+func (c *Client) token(params map[string]string) (string, error) {
+	realm := params["realm"]
+	if realm == "" {
+		return "", fmt.Errorf("bearer challenge without realm")
+	}
+	u, err := url.Parse(realm)
+	if err != nil {
+		return "", err
+	}
+	q := u.Query()
+	if params["service"] != "" {
+		q.Set("service", params["service"])
+	}
+	q.Set("scope", params["scope"])
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if c.Credentials.Username != "" {
+		req.SetBasicAuth(c.Credentials.Username, c.Credentials.Password)
+	}
+
+	log.DEBUG.Println("Requesting token to", u.Host, "for", params["scope"])
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("token request: %s", res.Status)
+	}
+
+	var t struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&t); err != nil {
+		return "", err
+	}
+	if t.Token != "" {
+		return t.Token, nil
+	}
+	if t.AccessToken != "" {
+		return t.AccessToken, nil
+	}
+	return "", fmt.Errorf("token request: no token in response")
+}
+
+// parseChallenge splits a WWW-Authenticate header in its scheme and parameters
+func parseChallenge(header string) (string, map[string]string) {
+	params := map[string]string{}
+	header = strings.TrimSpace(header)
+	i := strings.IndexByte(header, ' ')
+	if i == -1 {
+		return header, params
+	}
+	scheme, rest := header[:i], header[i+1:]
+
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " ,")
+		eq := strings.IndexByte(rest, '=')
+		if eq == -1 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.IndexByte(rest[1:], '"')
+			if end == -1 {
+				value, rest = rest[1:], ""
+			} else {
+				value, rest = rest[1:end+1], rest[end+2:]
+			}
+		} else if comma := strings.IndexByte(rest, ','); comma != -1 {
+			value, rest = rest[:comma], rest[comma:]
+		} else {
+			value, rest = rest, ""
+		}
+		params[key] = value
+	}
+	return scheme, params
+}
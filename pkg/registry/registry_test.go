@@ -0,0 +1,270 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/mudler/artemide/pkg/image"
+)
+
+// fakeRegistry is an in-process registry stand-in serving manifests and blobs by
+// digest or tag, behind an optional bearer token service or basic auth
+type fakeRegistry struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	objects   map[string]fakeObject // by path under /v2/<repo>/, e.g. manifests/latest
+	auth      string                // "", "bearer" or "basic"
+	user      string
+	password  string
+	token     string
+	tokenHits int
+}
+
+type fakeObject struct {
+	mediaType string
+	body      []byte
+}
+
+func newFakeRegistry(auth string) *fakeRegistry {
+	r := &fakeRegistry{
+		objects:  map[string]fakeObject{},
+		auth:     auth,
+		user:     "builder",
+		password: "secret",
+		token:    "t0k3n",
+	}
+	r.Server = httptest.NewServer(http.HandlerFunc(r.serve))
+	return r
+}
+
+func (r *fakeRegistry) ref(repository string, object string) Reference {
+	ref := Reference{Registry: strings.TrimPrefix(r.URL, "http://"), Repository: repository}
+	if strings.Contains(object, ":") {
+		ref.Digest = object
+	} else {
+		ref.Tag = object
+	}
+	return ref
+}
+
+func (r *fakeRegistry) client() *Client {
+	c := NewClient()
+	c.PlainHTTP = true
+	return c
+}
+
+// put stores an object, by its digest and by name when given
+func (r *fakeRegistry) put(kind string, name string, mediaType string, body []byte) string {
+	digest := image.FromBytes(body)
+	r.objects[kind+"/"+digest] = fakeObject{mediaType, body}
+	if name != "" {
+		r.objects[kind+"/"+name] = fakeObject{mediaType, body}
+	}
+	return digest
+}
+
+func (r *fakeRegistry) serve(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if req.URL.Path == "/token" {
+		r.tokenHits++
+		if user, password, ok := req.BasicAuth(); !ok || user != r.user || password != r.password {
+			http.Error(w, "bad credentials", http.StatusUnauthorized)
+			return
+		}
+		if req.URL.Query().Get("scope") != "repository:test/image:pull" || req.URL.Query().Get("service") != "fake" {
+			http.Error(w, "bad scope "+req.URL.RawQuery, http.StatusBadRequest)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"token": r.token})
+		return
+	}
+
+	switch r.auth {
+	case "bearer":
+		if req.Header.Get("Authorization") != "Bearer "+r.token {
+			w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="fake",scope="repository:test/image:pull"`, r.URL))
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	case "basic":
+		if user, password, ok := req.BasicAuth(); !ok || user != r.user || password != r.password {
+			w.Header().Set("WWW-Authenticate", `Basic realm="fake"`)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+
+	o, ok := r.objects[strings.TrimPrefix(req.URL.Path, "/v2/test/image/")]
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+	if o.mediaType != "" {
+		w.Header().Set("Content-Type", o.mediaType)
+	}
+	w.Write(o.body)
+}
+
+func mustJSON(t *testing.T, v interface{}) []byte {
+	b, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestTokenAuth(t *testing.T) {
+	r := newFakeRegistry("bearer")
+	defer r.Close()
+	manifest := mustJSON(t, image.Manifest{SchemaVersion: 2, MediaType: image.MediaTypeOCIManifest})
+	digest := r.put("manifests", "latest", image.MediaTypeOCIManifest, manifest)
+
+	c := r.client()
+	if _, _, _, err := c.Manifest(r.ref("test/image", "latest"), "latest"); err == nil {
+		t.Fatal("token granted without credentials")
+	}
+
+	c = r.client()
+	c.Credentials = Credentials{Username: "builder", Password: "secret"}
+	for i := 0; i < 2; i++ {
+		_, _, got, err := c.Manifest(r.ref("test/image", "latest"), "latest")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != digest {
+			t.Errorf("digest %s, want %s", got, digest)
+		}
+	}
+	if r.tokenHits != 2 {
+		t.Errorf("token requested %d times, want once for the anonymous client and once for the authenticated one", r.tokenHits)
+	}
+}
+
+func TestBasicAuthRetry(t *testing.T) {
+	r := newFakeRegistry("basic")
+	defer r.Close()
+	r.put("blobs", "", "", []byte("content"))
+	digest := image.FromBytes([]byte("content"))
+
+	c := r.client()
+	if _, err := c.Blob(r.ref("test/image", "latest"), digest); err == nil || !strings.Contains(err.Error(), "requires credentials") {
+		t.Errorf("anonymous request to a basic auth registry: %v", err)
+	}
+
+	c.Credentials = Credentials{Username: "builder", Password: "secret"}
+	blob, err := c.Blob(r.ref("test/image", "latest"), digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	if b, err := ioutil.ReadAll(blob); err != nil || string(b) != "content" {
+		t.Errorf("read %q, %v", b, err)
+	}
+
+	c.Credentials.Password = "wrong"
+	if _, err := c.Blob(r.ref("test/image", "latest"), digest); err == nil {
+		t.Error("wrong password accepted")
+	}
+}
+
+func TestResolvePlatform(t *testing.T) {
+	r := newFakeRegistry("")
+	defer r.Close()
+
+	var index image.Index
+	index.SchemaVersion = 2
+	index.MediaType = image.MediaTypeOCIIndex
+	digests := map[string]string{}
+	for _, p := range []image.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm", Variant: "v7"},
+		{OS: "linux", Architecture: "arm64", Variant: "v8"},
+	} {
+		manifest := mustJSON(t, image.Manifest{
+			SchemaVersion: 2,
+			MediaType:     image.MediaTypeOCIManifest,
+			Config:        image.Descriptor{Digest: image.FromBytes([]byte(p.String()))},
+		})
+		digest := r.put("manifests", "", image.MediaTypeOCIManifest, manifest)
+		digests[p.String()] = digest
+		platform := p
+		index.Manifests = append(index.Manifests, image.Descriptor{
+			MediaType: image.MediaTypeOCIManifest,
+			Digest:    digest,
+			Size:      int64(len(manifest)),
+			Platform:  &platform,
+		})
+	}
+	r.put("manifests", "latest", image.MediaTypeOCIIndex, mustJSON(t, index))
+
+	for platform, want := range map[string]string{
+		"linux/arm/v7":  digests["linux/arm/v7"],
+		"linux/arm64":   digests["linux/arm64/v8"],
+		"linux/amd64":   digests["linux/amd64"],
+		"linux/ppc64le": "",
+	} {
+		c := r.client()
+		p, err := image.ParsePlatform(platform)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Platform = p
+		_, digest, err := c.Resolve(r.ref("test/image", "latest"))
+		if want == "" {
+			if err == nil {
+				t.Errorf("%s: resolved %s, the index has no manifest for it", platform, digest)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", platform, err)
+			continue
+		}
+		if digest != want {
+			t.Errorf("%s: resolved %s, want %s", platform, digest, want)
+		}
+	}
+}
+
+func TestBlobDigestMismatch(t *testing.T) {
+	r := newFakeRegistry("")
+	defer r.Close()
+	digest := image.FromBytes([]byte("expected"))
+	r.objects["blobs/"+digest] = fakeObject{"", []byte("tampered")}
+
+	blob, err := r.client().Blob(r.ref("test/image", "latest"), digest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	if _, err := ioutil.ReadAll(blob); err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Errorf("tampered blob read without a digest mismatch: %v", err)
+	}
+}
+
+func TestManifestDigest(t *testing.T) {
+	r := newFakeRegistry("")
+	defer r.Close()
+	manifest := mustJSON(t, image.Manifest{SchemaVersion: 2, MediaType: image.MediaTypeOCIManifest})
+	digest := image.FromBytes(manifest)
+	r.objects["manifests/"+digest] = fakeObject{image.MediaTypeOCIManifest, append(manifest, ' ')}
+	sha512 := "sha512:" + strings.Repeat("ab", 64)
+	r.objects["manifests/"+sha512] = fakeObject{image.MediaTypeOCIManifest, manifest}
+
+	c := r.client()
+	if _, _, _, err := c.Manifest(r.ref("test/image", digest), digest); err == nil || !strings.Contains(err.Error(), "digest mismatch") {
+		t.Errorf("tampered manifest: %v", err)
+	}
+	if _, _, _, err := c.Manifest(r.ref("test/image", sha512), sha512); err == nil {
+		t.Error("manifest asked by an unsupported digest is trusted")
+	}
+}
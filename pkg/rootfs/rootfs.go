@@ -0,0 +1,300 @@
+// Package rootfs normalises the root filesystems unpacked by the sources
+package rootfs
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	jww "github.com/spf13/jwalterweatherman"
+
+	config "github.com/mudler/artemide/pkg/config"
+	"github.com/mudler/artemide/pkg/layer"
+)
+
+const SEPARATOR = string(filepath.Separator)
+
+// resolv.conf policies of the [prepare] section
+const (
+	ResolvConfHost   = "host"   // the build host one, the default
+	ResolvConfCustom = "custom" // written from the nameservers
+	ResolvConfKeep   = "keep"   // the one of the source, untouched
+)
+
+// DefaultStrip are the docker artefacts removed when the [prepare] section doesn't list them
+var DefaultStrip = []string{".dockerenv", ".dockerinit"}
+
+const (
+	resolvConf       = "etc" + SEPARATOR + "resolv.conf"
+	resolvConfBackup = resolvConf + ".artemide-orig"
+	resolvConfAbsent = resolvConfBackup + "-absent"
+	hostResolvConf   = "/etc/resolv.conf"
+	resolvedConf     = "/run/systemd/resolve/resolv.conf"
+)
+
+// Prepare cleans what the source leaves behind, and gets the rootfs ready for the chroot.
+// The resolv.conf of the source is put aside, Finalize restores it.
+func Prepare(dirname string, cfg config.Prepare) error {
+	strip := cfg.Strip
+	if strip == nil {
+		strip = DefaultStrip
+	}
+	for _, name := range strip {
+		path, err := rootPath(dirname, name)
+		if err != nil {
+			return err
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+	}
+
+	dev, err := rootPath(dirname, "dev")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dev, 0751); err != nil {
+		return err
+	}
+
+	if err := prepareResolvConf(dirname, cfg); err != nil {
+		return fmt.Errorf("resolv.conf: %s", err)
+	}
+
+	if cfg.Hostname != "" {
+		hostname, err := rootPath(dirname, "etc/hostname")
+		if err != nil {
+			return err
+		}
+		if err := replaceFile(hostname, []byte(cfg.Hostname+"\n")); err != nil {
+			return err
+		}
+	}
+	if cfg.Hostname != "" || len(cfg.Hosts) > 0 {
+		path, err := rootPath(dirname, "etc/hosts")
+		if err != nil {
+			return err
+		}
+		// The one of the source is edited, read where it leads in the rootfs
+		resolved, err := layer.SecureJoin(dirname, "etc/hosts")
+		if err != nil {
+			return err
+		}
+		current, err := ioutil.ReadFile(resolved)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := replaceFile(path, hosts(current, cfg)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Finalize undoes what was only needed to build, before packaging: the original
+// resolv.conf is restored, unless the build one is kept, and, if asked, the machine-id reset.
+// What Prepare put aside never ends up in the artifact.
+func Finalize(dirname string, cfg config.Prepare) error {
+	if cfg.ResolvConf != ResolvConfKeep {
+		restore := restoreResolvConf
+		if cfg.KeepBuildResolvConf {
+			restore = discardResolvConfBackup
+		}
+		if err := restore(dirname); err != nil {
+			return fmt.Errorf("resolv.conf: %s", err)
+		}
+	}
+
+	if cfg.ResetMachineID {
+		// An empty machine-id is generated again at first boot
+		machineID, err := rootPath(dirname, "etc/machine-id")
+		if err != nil {
+			return err
+		}
+		if _, err := os.Lstat(machineID); err == nil {
+			if err := replaceFile(machineID, nil); err != nil {
+				return err
+			}
+		}
+		dbusID, err := rootPath(dirname, "var/lib/dbus/machine-id")
+		if err != nil {
+			return err
+		}
+		if fi, err := os.Lstat(dbusID); err == nil && fi.Mode().IsRegular() {
+			if err := os.Remove(dbusID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func prepareResolvConf(dirname string, cfg config.Prepare) error {
+	var content []byte
+	switch cfg.ResolvConf {
+	case ResolvConfKeep:
+		return nil
+	case ResolvConfCustom:
+		for _, ns := range cfg.Nameservers {
+			content = append(content, []byte("nameserver "+ns+"\n")...)
+		}
+	case "", ResolvConfHost:
+		var err error
+		if content, err = hostNameservers(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown policy %q", cfg.ResolvConf)
+	}
+
+	// Renamed, not copied: it may be a symlink, pointing out of the rootfs once followed from the host
+	original, backup, absent, err := resolvConfPaths(dirname)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(original), 0755); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(backup); os.IsNotExist(err) {
+		if _, err := os.Lstat(original); err == nil {
+			if err := os.Rename(original, backup); err != nil {
+				return err
+			}
+		} else if err := ioutil.WriteFile(absent, nil, 0644); err != nil {
+			return err
+		}
+	}
+
+	return replaceFile(original, content)
+}
+
+func restoreResolvConf(dirname string) error {
+	original, backup, absent, err := resolvConfPaths(dirname)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Lstat(backup); err == nil {
+		jww.DEBUG.Println("Restoring", original)
+		if err := os.Remove(original); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return os.Rename(backup, original)
+	}
+	if _, err := os.Lstat(absent); err == nil {
+		if err := os.Remove(original); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return os.Remove(absent)
+	}
+	return nil
+}
+
+// discardResolvConfBackup keeps the build resolv.conf, removing the one of the source
+func discardResolvConfBackup(dirname string) error {
+	_, backup, absent, err := resolvConfPaths(dirname)
+	if err != nil {
+		return err
+	}
+	for _, path := range []string{backup, absent} {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func resolvConfPaths(dirname string) (original string, backup string, absent string, err error) {
+	if original, err = rootPath(dirname, resolvConf); err != nil {
+		return
+	}
+	if backup, err = rootPath(dirname, resolvConfBackup); err != nil {
+		return
+	}
+	absent, err = rootPath(dirname, resolvConfAbsent)
+	return
+}
+
+// hostNameservers returns the resolv.conf of the build host. The local stub of
+// systemd-resolved is unreachable from the chroot, the upstream servers are used then.
+func hostNameservers() ([]byte, error) {
+	content, err := ioutil.ReadFile(hostResolvConf)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Contains(string(content), "nameserver 127.0.0.53") {
+		if upstream, err := ioutil.ReadFile(resolvedConf); err == nil {
+			return upstream, nil
+		}
+		jww.WARN.Println("The host resolv.conf points to the systemd-resolved stub, name resolution may fail in the chroot")
+	}
+	return content, nil
+}
+
+// hosts returns the /etc/hosts of the rootfs from its current content, the loopback names
+// when there is none: the hostname is added to the loopback line, the configured entries appended
+func hosts(current []byte, cfg config.Prepare) []byte {
+	if len(bytes.TrimSpace(current)) == 0 {
+		current = []byte("127.0.0.1\tlocalhost\n::1\tlocalhost ip6-localhost ip6-loopback\n")
+	}
+	lines := strings.Split(strings.TrimSuffix(string(current), "\n"), "\n")
+
+	if cfg.Hostname != "" {
+		loopback := -1
+		for i, line := range lines {
+			if fields := strings.Fields(line); len(fields) > 0 && fields[0] == "127.0.0.1" {
+				loopback = i
+				break
+			}
+		}
+		switch {
+		case loopback == -1:
+			lines = append(lines, "127.0.0.1\t"+cfg.Hostname)
+		case !contains(strings.Fields(lines[loopback])[1:], cfg.Hostname):
+			fields := strings.Fields(lines[loopback])
+			lines[loopback] = fields[0] + "\t" + strings.Join(append([]string{cfg.Hostname}, fields[1:]...), " ")
+		}
+	}
+
+	for _, entry := range cfg.Hosts {
+		if !contains(lines, entry) {
+			lines = append(lines, entry)
+		}
+	}
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+func contains(list []string, s string) bool {
+	for _, e := range list {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
+
+// rootPath returns where name is in the rootfs dirname. Its parents are resolved in the rootfs,
+// the last component is not followed: it is replaced, renamed or removed, never written thru.
+func rootPath(dirname string, name string) (string, error) {
+	clean := filepath.Clean(SEPARATOR + name)
+	if clean == SEPARATOR {
+		return "", fmt.Errorf("%q is the root of %s", name, dirname)
+	}
+	parent, err := layer.SecureJoin(dirname, filepath.Dir(clean))
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(parent, filepath.Base(clean)), nil
+}
+
+// replaceFile writes a new regular file at path: a symlink there is replaced, not followed.
+// path must come from rootPath, so its parents don't lead out of the rootfs either.
+func replaceFile(path string, content []byte) error {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return ioutil.WriteFile(path, content, 0644)
+}
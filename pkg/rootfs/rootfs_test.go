@@ -0,0 +1,79 @@
+package rootfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	config "github.com/mudler/artemide/pkg/config"
+)
+
+func TestPrepareSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rootfs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	root, host := filepath.Join(dir, "root"), filepath.Join(dir, "host")
+	for _, d := range []string{root, host} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, name := range []string{"hosts", "hostname", "resolv.conf", "strip"} {
+		if err := ioutil.WriteFile(filepath.Join(host, name), []byte("host\n"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Absolute links, as the image has them: followed from the host they lead out of the rootfs
+	for name, target := range map[string]string{"etc": host, "strip": host} {
+		if err := os.Symlink(target, filepath.Join(root, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	cfg := config.Prepare{
+		Strip:       []string{"strip/strip"},
+		ResolvConf:  ResolvConfCustom,
+		Nameservers: []string{"10.0.0.1"},
+		Hostname:    "board",
+	}
+	if err := Prepare(root, cfg); err != nil {
+		t.Fatal(err)
+	}
+	if err := Finalize(root, cfg); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"hosts", "hostname", "resolv.conf", "strip"} {
+		if body, err := ioutil.ReadFile(filepath.Join(host, name)); err != nil || string(body) != "host\n" {
+			t.Errorf("the host %s was changed: %q, %v", name, body, err)
+		}
+	}
+	if body, err := ioutil.ReadFile(filepath.Join(root, host, "hostname")); err != nil || string(body) != "board\n" {
+		t.Errorf("hostname in the rootfs is %q, %v", body, err)
+	}
+}
+
+func TestHosts(t *testing.T) {
+	for _, tc := range []struct {
+		current string
+		cfg     config.Prepare
+		want    string
+	}{
+		{"", config.Prepare{Hostname: "board"},
+			"127.0.0.1\tboard localhost\n::1\tlocalhost ip6-localhost ip6-loopback\n"},
+		{"# image\n127.0.0.1 localhost.localdomain localhost\n10.1.1.1 nas\n", config.Prepare{Hostname: "board"},
+			"# image\n127.0.0.1\tboard localhost.localdomain localhost\n10.1.1.1 nas\n"},
+		{"127.0.0.1\tboard localhost\n", config.Prepare{Hostname: "board", Hosts: []string{"10.0.0.2 mirror.lan"}},
+			"127.0.0.1\tboard localhost\n10.0.0.2 mirror.lan\n"},
+		{"::1 localhost\n", config.Prepare{Hostname: "board"},
+			"::1 localhost\n127.0.0.1\tboard\n"},
+		{"127.0.0.1 localhost\n10.0.0.2 mirror.lan\n", config.Prepare{Hosts: []string{"10.0.0.2 mirror.lan"}},
+			"127.0.0.1 localhost\n10.0.0.2 mirror.lan\n"},
+	} {
+		if got := string(hosts([]byte(tc.current), tc.cfg)); got != tc.want {
+			t.Errorf("%q with %+v: got %q, want %q", tc.current, tc.cfg, got, tc.want)
+		}
+	}
+}
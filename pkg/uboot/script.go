@@ -0,0 +1,55 @@
+// Package uboot writes what U-Boot reads, without needing its mkimage tool
+package uboot
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"time"
+)
+
+const (
+	headerSize = 64
+	magic      = 0x27051956
+
+	osLinux    = 5
+	typeScript = 6
+	compNone   = 0
+)
+
+// Architectures of the legacy image header, by GOARCH
+var arches = map[string]byte{
+	"arm":   2,
+	"arm64": 22,
+}
+
+// Script wraps a boot script in a legacy image, the boot.scr U-Boot sources. It is what
+// mkimage -A <arch> -O linux -T script -C none -n <name> writes.
+func Script(script []byte, name string, arch string) ([]byte, error) {
+	a, ok := arches[arch]
+	if !ok {
+		return nil, fmt.Errorf("no u-boot architecture for %s", arch)
+	}
+	if len(name) > 32 {
+		return nil, fmt.Errorf("image name %q longer than 32 characters", name)
+	}
+
+	// Scripts are multi-file images: the size of each file, 0, then the files
+	data := make([]byte, 8+len(script))
+	binary.BigEndian.PutUint32(data[0:4], uint32(len(script)))
+	copy(data[8:], script)
+
+	h := make([]byte, headerSize)
+	binary.BigEndian.PutUint32(h[0:4], magic)
+	binary.BigEndian.PutUint32(h[8:12], uint32(time.Now().Unix()))
+	binary.BigEndian.PutUint32(h[12:16], uint32(len(data)))
+	binary.BigEndian.PutUint32(h[24:28], crc32.ChecksumIEEE(data))
+	h[28] = osLinux
+	h[29] = a
+	h[30] = typeScript
+	h[31] = compNone
+	copy(h[32:64], name)
+	binary.BigEndian.PutUint32(h[4:8], crc32.ChecksumIEEE(h))
+
+	return append(h, data...), nil
+}
@@ -0,0 +1,50 @@
+// Package units parses and prints the sizes of the configuration and the logs
+package units
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+var sizeUnits = []string{"K", "M", "G", "T"}
+
+// ParseSize parses a size in bytes, or with a K, M, G or T suffix (powers of 1024), e.g. "20G"
+func ParseSize(size string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(size))
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "B"), "I")
+
+	multiplier := float64(1)
+	for i, unit := range sizeUnits {
+		if strings.HasSuffix(s, unit) {
+			s = strings.TrimSuffix(s, unit)
+			multiplier = float64(uint64(1) << (10 * uint(i+1)))
+			break
+		}
+	}
+
+	// ParseFloat also takes inf and nan, which are no sizes
+	n, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || n < 0 || math.IsNaN(n) || math.IsInf(n, 0) || n*multiplier >= math.MaxInt64 {
+		return 0, fmt.Errorf("invalid size %q (expected e.g. 512M or 20G)", size)
+	}
+	return int64(n * multiplier), nil
+}
+
+// FormatSize prints a size in bytes with the largest unit it has
+func FormatSize(size int64) string {
+	value := float64(size)
+	unit := "B"
+	for _, u := range sizeUnits {
+		if value < 1024 {
+			break
+		}
+		value /= 1024
+		unit = u
+	}
+	if unit == "B" {
+		return fmt.Sprintf("%dB", size)
+	}
+	return fmt.Sprintf("%.1f%s", value, unit)
+}
@@ -0,0 +1,25 @@
+package units
+
+import "testing"
+
+func TestParseSize(t *testing.T) {
+	for _, tc := range []struct {
+		size string
+		want int64
+	}{
+		{"512", 512},
+		{"1K", 1024},
+		{"1.5M", 3 << 19},
+		{"20GiB", 20 << 30},
+		{" 2 t ", 2 << 40},
+	} {
+		if got, err := ParseSize(tc.size); err != nil || got != tc.want {
+			t.Errorf("%q: got %d, %v, want %d", tc.size, got, err, tc.want)
+		}
+	}
+	for _, size := range []string{"", "G", "-1M", "inf", "+Inf", "nan", "NaNG", "9000000T", "1e30"} {
+		if got, err := ParseSize(size); err == nil {
+			t.Errorf("%q: got %d, want an error", size, got)
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package plugin
+
+import (
+	"github.com/mudler/artemide/pkg/cache"
+	config "github.com/mudler/artemide/pkg/config"
+	"github.com/mudler/artemide/pkg/units"
+)
+
+// OpenCache opens the cache the sources store what they unpack in, it is nil when disabled
+func OpenCache(cfg config.Cache) (*cache.Cache, error) {
+	if cfg.Disabled {
+		return nil, nil
+	}
+
+	dir := cfg.Dir
+	if dir == "" {
+		dir = cache.DefaultDir()
+	}
+	var maxSize int64
+	if cfg.MaxSize != "" {
+		var err error
+		if maxSize, err = units.ParseSize(cfg.MaxSize); err != nil {
+			return nil, err
+		}
+	}
+	return cache.Open(dir, maxSize)
+}
@@ -0,0 +1,75 @@
+package plugin
+
+import (
+	"time"
+
+	config "github.com/mudler/artemide/pkg/config"
+	"github.com/mudler/artemide/pkg/context"
+	"github.com/mudler/artemide/pkg/errwrap"
+)
+
+// Event is published to the recipes for each event declared in an artifact,
+// and to the hooks for each lifecycle phase (with no Recipe set).
+// The bus drops the handlers return values, so they report back thru it
+type Event struct {
+	Artifact string        // name of the artifact being built
+	Recipe   string        // recipe the event belongs to
+	ID       string        // event identifier in the configuration
+	Name     string        // lifecycle phase the event is bound to
+	Action   string        // action configured for the event
+	Timeout  time.Duration // how long the action may run, 0 leaves it to the recipe
+	Config   config.Event  // the event definition, empty for phase events
+	Context  *context.Context
+	Err      error
+}
+
+// Fail marks the event as failed
+func (e *Event) Fail(err error) {
+	e.Err = err
+}
+
+// Failf marks the event as failed, wrapping err: format must contain {{err}}, e.g. "pulling %s: {{err}}"
+func (e *Event) Failf(err error, format string, v ...interface{}) {
+	e.Err = errwrap.Wrapff(err, format, v...)
+}
+
+// State returns the artifact state in the build context: its directories, outputs and phase
+func (e *Event) State() *context.Artifact {
+	return e.Context.Artifact(e.Artifact)
+}
+
+// Failed tells if any handler reported an error
+func (e *Event) Failed() bool {
+	return e.Err != nil
+}
+
+// EventTopic returns the topic on which the recipe receives the named event
+func EventTopic(recipe string, name string) string {
+	return "artemide:artifact:recipe:" + recipe + ":event:" + name
+}
+
+// PhaseTopic returns the topic on which hooks receive the lifecycle phase of every artifact
+func PhaseTopic(phase string) string {
+	return "artemide:artifact:phase:" + phase
+}
+
+// SourceTopic returns the topic on which the source type is asked to unpack in the artifact rootfs
+func SourceTopic(sourceType string) string {
+	return "artemide:source:" + sourceType
+}
+
+// PackageTopic returns the topic on which the artifact type is asked to package the artifact
+// rootfs, once the hooks of before_package are done
+func PackageTopic(artifactType string) string {
+	return "artemide:artifact:package:" + artifactType
+}
+
+// SourceDigestKey is the context key the sources store the digest, or id, of the unpacked image at
+const SourceDigestKey = "source.digest"
+
+// SourceConfigKey is the context key the sources store the image.Config of the unpacked image at,
+// when they know it
+const SourceConfigKey = "source.config"
+
+// CleanupTopic is published when an artifact failed, so the hooks can release what they hold
+const CleanupTopic = "artemide:artifact:cleanup"
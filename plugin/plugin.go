@@ -6,10 +6,13 @@ import (
 	"strings"
 
 	evbus "github.com/asaskevich/EventBus"
+	config "github.com/mudler/artemide/pkg/config"
 	"github.com/mudler/artemide/pkg/context"
 )
 
-// Hook register it's events to the eventbus
+// Hook register it's events to the eventbus.
+// The handlers of the artifact and source topics receive an *Event: they report failures
+// with Event.Fail, and must never exit the process, so the build can clean up after them.
 type Hook interface {
 	Register(*evbus.EventBus, *context.Context) // processor gets the workdir and the config file
 }
@@ -25,6 +28,30 @@ var Hooks = map[string]Hook{}
 // Recipes contains a map of Recipe
 var Recipes = map[string]Recipe{}
 
+// Known lists what the registered plugins handle in the configuration, to validate it
+var Known = config.Known{}
+
+// HandleSource declares a [source] type handled by a plugin
+func HandleSource(name string) {
+	Known.Sources = append(Known.Sources, name)
+}
+
+// HandlePathSource declares a [source] type unpacking a local path, given as source.path
+func HandlePathSource(name string) {
+	HandleSource(name)
+	Known.PathSources = append(Known.PathSources, name)
+}
+
+// HandleRecipe declares a recipe name usable in the artifacts
+func HandleRecipe(name string) {
+	Known.Recipes = append(Known.Recipes, name)
+}
+
+// HandleArtifactType declares an artifact type a plugin packages, on PackageTopic
+func HandleArtifactType(name string) {
+	Known.Types = append(Known.Types, name)
+}
+
 // RegisterHook Registers a Hook
 func RegisterHook(h Hook) {
 	Hooks[keyOf(h)] = h
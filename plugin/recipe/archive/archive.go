@@ -0,0 +1,60 @@
+package archive
+
+import (
+	evbus "github.com/asaskevich/EventBus"
+	"github.com/mudler/artemide/pkg/context"
+	"github.com/mudler/artemide/pkg/image"
+	"github.com/mudler/artemide/pkg/layout"
+	plugin "github.com/mudler/artemide/plugin"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+// Archive unpacks images saved locally, so builds need neither a daemon nor the network.
+// source.path is a docker save tar, or an OCI image layout directory or tar;
+// source.image optionally picks the image when it holds more than one.
+type Archive struct{}
+
+// Register subscribes to the docker-archive and oci-layout sources
+func (a *Archive) Register(bus *evbus.EventBus, context *context.Context) {
+	bus.Subscribe("artemide:start", Start)
+	bus.Subscribe(plugin.SourceTopic("docker-archive"), unpackDockerArchive)
+	bus.Subscribe(plugin.SourceTopic("oci-layout"), unpackOCILayout)
+}
+
+func unpackDockerArchive(e *plugin.Event) {
+	unpack(e, layout.UnpackDockerArchive)
+}
+
+func unpackOCILayout(e *plugin.Event) {
+	unpack(e, layout.UnpackOCILayout)
+}
+
+func unpack(e *plugin.Event, unpacker func(string, string, image.Platform, string) (string, image.Config, error)) {
+	source := e.Context.Config.Source
+	dir := e.State().Rootfs
+
+	platform, err := source.TargetPlatform()
+	if err != nil {
+		e.Fail(err)
+		return
+	}
+
+	id, cfg, err := unpacker(source.Path, source.Image, platform, dir)
+	if err != nil {
+		e.Failf(err, "unpacking %s: {{err}}", source.Path)
+		return
+	}
+	jww.INFO.Println("Unpacked", source.Path, "("+id+") to", dir)
+	e.Context.Set(plugin.SourceDigestKey, id)
+	e.Context.Set(plugin.SourceConfigKey, cfg)
+}
+
+func Start() {
+	jww.DEBUG.Printf("[recipe] Archive is available")
+}
+
+func init() {
+	plugin.RegisterRecipe(&Archive{})
+	plugin.HandlePathSource("docker-archive")
+	plugin.HandlePathSource("oci-layout")
+}
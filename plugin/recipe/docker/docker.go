@@ -2,16 +2,24 @@ package docker
 
 import (
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strings"
 	"time"
 
 	evbus "github.com/asaskevich/EventBus"
 	"github.com/fsouza/go-dockerclient"
 
+	"github.com/mudler/artemide/pkg/cache"
+	config "github.com/mudler/artemide/pkg/config"
 	"github.com/mudler/artemide/pkg/context"
+	"github.com/mudler/artemide/pkg/dockerutil"
+	"github.com/mudler/artemide/pkg/errwrap"
+	imagespec "github.com/mudler/artemide/pkg/image"
+	"github.com/mudler/artemide/pkg/layer"
+	"github.com/mudler/artemide/pkg/registry"
 	plugin "github.com/mudler/artemide/plugin"
 	jww "github.com/spf13/jwalterweatherman"
 )
@@ -19,25 +27,44 @@ import (
 const SEPARATOR = string(filepath.Separator)
 const ROOT_FS = "." + SEPARATOR + "rootfs_overlay"
 
-// Script construct the container arguments from the boson file
+// Docker is the docker source, unpacking an image thru the daemon, and the docker-image artifact type
 type Docker struct{}
 
-// Process builds a list of packages from the boson file
-func (d *Docker) Register(bus *evbus.EventBus, context *context.Context) { //returns args and volumes to mount
-
-	client, _ := NewClient("unix:///var/run/docker.sock")
-
-	bus.Subscribe("artemide:start", Start) //Subscribing to artemide:start, Hello will be called
-	bus.Subscribe("artemide:source:docker", client.Unpack)
+// Register subscribes to the docker source and to the packaging of the docker-image artifacts
+func (d *Docker) Register(bus *evbus.EventBus, context *context.Context) {
+	bus.Subscribe("artemide:start", Start)
+	bus.Subscribe(plugin.SourceTopic("docker"), func(e *plugin.Event) {
+		// The configuration is loaded after the plugins register, so is the daemon endpoint
+		client, err := NewClient(e.Context.Config.Docker)
+		if err != nil {
+			e.Failf(err, "docker is not available: {{err}}")
+			return
+		}
+		if client.Cache, err = plugin.OpenCache(e.Context.Config.Cache); err != nil {
+			jww.WARN.Println("Cache disabled:", err)
+		}
+		source := e.Context.Config.Source
+		digest, cfg, uerr := client.Unpack(source, e.State().Rootfs)
+		if uerr != nil {
+			e.Failf(uerr, "unpacking %s: {{err}}", source.Image)
+			return
+		}
+		e.Context.Set(plugin.SourceDigestKey, digest)
+		e.Context.Set(plugin.SourceConfigKey, cfg)
+	})
+	bus.Subscribe(plugin.PackageTopic(ImageType), packageImage)
 
 }
 
 type Client struct {
+	Cache *cache.Cache // where the exported rootfs are kept, nil disables it
+
 	docker *docker.Client
 }
 
-func NewClient(endpoint string) (*Client, error) {
-	client, err := docker.NewClient(endpoint)
+// NewClient connects to the daemon of the [docker] configuration
+func NewClient(cfg config.Docker) (*Client, error) {
+	client, err := dockerutil.NewClient(cfg)
 	if err != nil {
 		return nil, err
 	}
@@ -46,41 +73,99 @@ func NewClient(endpoint string) (*Client, error) {
 	}, nil
 }
 
-func (client *Client) Unpack(image string, dirname string) (bool, error) {
+// Unpack pulls the source image, for the source platform when given, and extracts
+// its filesystem in dirname. It returns the image digest, or its id when it has none,
+// and the image configuration.
+func (client *Client) Unpack(source config.Source, dirname string) (string, imagespec.Config, error) {
 	var err error
+	image := source.Image
 
 	if dirname == "" {
 		dirname = ROOT_FS
 	}
 
-	os.MkdirAll(dirname, 0777)
-
-	filename, err := ioutil.TempFile(os.TempDir(), "artemide")
+	platform, err := source.TargetPlatform()
 	if err != nil {
-		jww.FATAL.Fatal("Couldn't create the temporary file")
+		return "", imagespec.Config{}, err
+	}
+
+	if err = os.MkdirAll(dirname, 0777); err != nil {
+		return "", imagespec.Config{}, err
 	}
-	os.Remove(filename.Name())
 
 	// Pulling the image
 	jww.INFO.Printf("Pulling the docker image %s\n", image)
-	if err := client.docker.PullImage(docker.PullImageOptions{Repository: image}, docker.AuthConfiguration{}); err != nil {
+	pull := docker.PullImageOptions{Repository: image}
+	if source.Platform != "" {
+		pull.Platform = platform.String()
+	}
+	auth, err := authConfiguration(source)
+	if err != nil {
+		return "", imagespec.Config{}, err
+	}
+	if err := client.docker.PullImage(pull, auth); err != nil {
 		jww.ERROR.Printf("error pulling %s image: %s\n", image, err)
-		return false, err
+		return "", imagespec.Config{}, err
 	} else {
 		jww.INFO.Println("Image", image, "pulled correctly")
 	}
 
+	// The daemon may ignore the platform, or have another one of the image cached
+	inspected, err := client.docker.InspectImage(image)
+	if err != nil {
+		return "", imagespec.Config{}, errwrap.Wrapf(err, "Couldn't inspect the image: {{err}}")
+	}
+	if source.Platform != "" {
+		wanted := platform
+		wanted.Variant = "" // not reported by the daemon
+		got := imagespec.Platform{OS: inspected.OS, Architecture: inspected.Architecture}
+		if !wanted.Matches(got) {
+			return "", imagespec.Config{}, fmt.Errorf("%s is built for %s, not %s", image, got, platform)
+		}
+	}
+	digest := repoDigest(image, inspected)
+
+	// The export is cached by the image id, which covers its layers
+	key := cache.Key(inspected.ID, nil)
+	entry := cache.Entry{Image: image, Digest: digest}
+	if err := client.Cache.Unpack(key, entry, dirname, func() error { return client.export(image, dirname) }); err != nil {
+		return "", imagespec.Config{}, err
+	}
+	return digest, dockerutil.ImageConfig(inspected), nil
+}
+
+// repoDigest returns the manifest digest the daemon recorded for image, among those of the
+// repositories it was pulled from, or its id when it has none for the repository of image
+func repoDigest(image string, inspected *docker.Image) string {
+	ref, err := registry.ParseReference(image)
+	if err != nil {
+		return inspected.ID
+	}
+	for _, d := range inspected.RepoDigests {
+		i := strings.Index(d, "@")
+		if i == -1 {
+			continue
+		}
+		r, err := registry.ParseReference(d)
+		if err == nil && r.Registry == ref.Registry && r.Repository == ref.Repository {
+			return d[i+1:]
+		}
+	}
+	return inspected.ID
+}
+
+// export streams the filesystem of a container created from image straight into dirname
+func (client *Client) export(image string, dirname string) error {
 	History, _ := client.docker.ImageHistory(image)
 
 	for i := len(History) - 1; i >= 0; i-- {
-		layer := History[i]
-		layerCreated := time.Unix(layer.Created, 0)
-		jww.DEBUG.Println("Layer ", layer.ID, layerCreated)
+		h := History[i]
+		layerCreated := time.Unix(h.Created, 0)
+		jww.DEBUG.Println("Layer ", h.ID, layerCreated)
 
 	}
 
 	jww.INFO.Println("Creating container")
-	//flatten.Flatten("flat", image)
 
 	container, err := client.docker.CreateContainer(docker.CreateContainerOptions{
 		Config: &docker.Config{
@@ -88,6 +173,9 @@ func (client *Client) Unpack(image string, dirname string) (bool, error) {
 			Cmd:   []string{"true"},
 		},
 	})
+	if err != nil {
+		return errwrap.Wrapf(err, "Couldn't create the container: {{err}}")
+	}
 	defer func(*docker.Container) {
 		client.docker.RemoveContainer(docker.RemoveContainerOptions{
 			ID:    container.ID,
@@ -95,72 +183,71 @@ func (client *Client) Unpack(image string, dirname string) (bool, error) {
 		})
 	}(container)
 
-	target := fmt.Sprintf("%s.tar", filename.Name())
-	jww.DEBUG.Printf("Writing to target %s\n", target)
-	writer, err := os.Create(target)
-	if err != nil {
-		return false, err
-	}
-
-	err = client.docker.ExportContainer(docker.ExportContainerOptions{ID: container.ID, OutputStream: writer})
-	if err != nil {
-		jww.FATAL.Fatalln("Couldn't export container, sorry", err)
-	}
+	reader, writer := io.Pipe()
+	exported := make(chan error, 1)
+	go func() {
+		err := client.docker.ExportContainer(docker.ExportContainerOptions{ID: container.ID, OutputStream: writer})
+		writer.CloseWithError(err)
+		exported <- err
+	}()
 
-	writer.Sync()
-
-	writer.Close()
 	jww.INFO.Println("Extracting to", dirname)
-
-	untar(target, dirname)
-	err = os.Remove(target)
+	stats, err := layer.Apply(reader, dirname, layer.Options{
+		Exclude:     []string{"dev"}, // prevent operation not permitted, the devices are created by the chroot
+		NoWhiteouts: true,
+		Progress:    progress(image),
+	})
 	if err != nil {
-		jww.ERROR.Println("could not remove temporary file", target)
+		// Stops the export, its writes fail from now on
+		reader.CloseWithError(err)
+		<-exported
+		return errwrap.Wrapf(err, "Couldn't extract the container: {{err}}")
 	}
-	prepareRootfs(dirname)
 
-	return true, err
+	// What follows the end of the tar must be read, or the export never completes
+	io.Copy(ioutil.Discard, reader)
+	if err := <-exported; err != nil {
+		return errwrap.Wrapf(err, "Couldn't export container: {{err}}")
+	}
+	jww.INFO.Printf("Extracted %s: %s\n", image, stats)
+	return nil
 }
 
-func prepareRootfs(dirname string) {
-
-	err := os.Remove(dirname + SEPARATOR + ".dockerenv")
-	if err != nil {
-		jww.ERROR.Println("could not remove docker env file")
+// progress logs the extraction every few seconds
+func progress(image string) func(layer.Stats) {
+	last := time.Now()
+	return func(stats layer.Stats) {
+		if time.Since(last) < 5*time.Second {
+			return
+		}
+		last = time.Now()
+		jww.INFO.Printf("Extracting %s: %s\n", image, stats)
 	}
+}
 
-	err = os.Remove(dirname + SEPARATOR + ".dockerinit")
+// authConfiguration resolves the credentials of the image registry, the pull is anonymous when it has none
+func authConfiguration(source config.Source) (docker.AuthConfiguration, error) {
+	ref, err := registry.ParseReference(source.Image)
 	if err != nil {
-		jww.ERROR.Println("could not remove docker init file")
+		return docker.AuthConfiguration{}, err
 	}
-
-	err = os.MkdirAll(dirname+SEPARATOR+"dev", 0751)
+	creds, err := registry.ResolveCredentials(ref.Registry, source.Username, source.PasswordEnv)
 	if err != nil {
-		jww.ERROR.Println("could not create dev folder")
+		return docker.AuthConfiguration{}, errwrap.Wrapff(err, "credentials of %s: {{err}}", ref.Registry)
 	}
-
-	// Google DNS as default
-	d1 := []byte("nameserver 8.8.8.8\nnameserver 8.8.4.4\n")
-	err = ioutil.WriteFile(dirname+SEPARATOR+"etc"+SEPARATOR+"resolv.conf", d1, 0644)
-
+	return docker.AuthConfiguration{
+		Username:      creds.Username,
+		Password:      creds.Password,
+		ServerAddress: registry.ServerAddress(ref.Registry),
+	}, nil
 }
 
 func Start() {
 	jww.DEBUG.Printf("[recipe] Docker is available")
 }
 
-func untar(src string, dst string) string {
-
-	// this should be used instead https://github.com/yuuki1/droot/blob/d0a19947ca0ab057d1eb8cfd471ce6863675b64f/archive/util.go#L19
-	// temporary code to move on.
-	cmd := "tar -xf " + src + " -C " + dst + " --exclude='dev'"
-	out, err := exec.Command("bash", "-c", cmd).Output()
-	if err != nil {
-		jww.FATAL.Fatalf("Failed to execute command: %s", cmd)
-	}
-	return string(out)
-}
-
 func init() {
 	plugin.RegisterRecipe(&Docker{})
+	plugin.HandleSource("docker")
+	plugin.HandleArtifactType(ImageType)
 }
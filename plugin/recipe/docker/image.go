@@ -0,0 +1,125 @@
+package docker
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/fsouza/go-dockerclient"
+	jww "github.com/spf13/jwalterweatherman"
+
+	"github.com/mudler/artemide/pkg/flatten"
+	imagespec "github.com/mudler/artemide/pkg/image"
+	plugin "github.com/mudler/artemide/plugin"
+)
+
+// ImageType is the artifact type packaging the rootfs as a single layer image
+const ImageType = "docker-image"
+
+// packageImage builds the image of a docker-image artifact from its rootfs
+func packageImage(e *plugin.Event) {
+	state := e.State()
+	settings := e.Context.Config.Artifacts[e.Artifact].Image
+	cfg, err := sourceConfig(e)
+	if err != nil {
+		e.Fail(err)
+		return
+	}
+	settings.Config.Apply(&cfg.Config)
+	src := &flatten.DirSource{Dir: state.Rootfs, ImageConfig: cfg}
+	opts := flatten.Options{Tag: settings.Tag, Format: settings.Format, Comment: comment(e)}
+
+	var archive string
+	if settings.Archive != "" {
+		archive = filepath.Join(state.Output, settings.Archive)
+		id, err := flatten.WriteFile(src, archive, opts)
+		if err != nil {
+			e.Failf(err, "writing %s: {{err}}", archive)
+			return
+		}
+		state.AddOutput(archive)
+		jww.INFO.Printf("[%s] Wrote %s, image %s\n", e.Artifact, archive, id)
+	}
+
+	if !settings.Load {
+		return
+	}
+	client, err := NewClient(e.Context.Config.Docker)
+	if err != nil {
+		e.Failf(err, "docker is not available: {{err}}")
+		return
+	}
+	// The docker archive just written is loaded as is, otherwise the daemon gets its own
+	if archive != "" && (settings.Format == "" || settings.Format == flatten.FormatDocker) {
+		err = client.LoadFile(archive)
+	} else {
+		err = client.Load(src, opts)
+	}
+	if err != nil {
+		e.Failf(err, "loading %s: {{err}}", settings.Tag)
+		return
+	}
+	jww.INFO.Printf("[%s] Loaded %s\n", e.Artifact, settings.Tag)
+}
+
+// sourceConfig returns the configuration of the source image, when the source knows it,
+// otherwise an empty one for the platform of the source
+func sourceConfig(e *plugin.Event) (imagespec.Config, error) {
+	if v, ok := e.Context.Get(plugin.SourceConfigKey); ok {
+		if cfg, ok := v.(imagespec.Config); ok {
+			return cfg, nil
+		}
+	}
+
+	platform, err := e.Context.Config.Source.TargetPlatform()
+	if err != nil {
+		return imagespec.Config{}, err
+	}
+	if platform.OS == "" {
+		platform = imagespec.HostPlatform()
+	}
+	return imagespec.Config{
+		OS:           platform.OS,
+		Architecture: platform.Architecture,
+		Variant:      platform.Variant,
+	}, nil
+}
+
+// comment describes what the artifact was built from, for the image history
+func comment(e *plugin.Event) string {
+	source := e.Context.Config.Source
+	c := fmt.Sprintf("artifact %s built from the %s source %s", e.Artifact, source.Type, source.Location())
+	if digest, ok := e.Context.GetString(plugin.SourceDigestKey); ok {
+		c += " (" + digest + ")"
+	}
+	return c
+}
+
+// Load flattens src straight into the daemon, opts.Format is ignored
+func (client *Client) Load(src flatten.Source, opts flatten.Options) error {
+	opts.Format = flatten.FormatDocker
+	reader, writer := io.Pipe()
+	flattened := make(chan error, 1)
+	go func() {
+		_, err := flatten.Flatten(src, writer, opts)
+		writer.CloseWithError(err)
+		flattened <- err
+	}()
+	err := client.docker.LoadImage(docker.LoadImageOptions{InputStream: reader})
+	reader.Close()
+	if ferr := <-flattened; ferr != nil {
+		return ferr
+	}
+	return err
+}
+
+// LoadFile loads an archive in the format of docker save
+func (client *Client) LoadFile(archive string) error {
+	f, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return client.docker.LoadImage(docker.LoadImageOptions{InputStream: f})
+}
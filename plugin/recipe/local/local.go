@@ -0,0 +1,68 @@
+package local
+
+import (
+	"fmt"
+	"os"
+
+	evbus "github.com/asaskevich/EventBus"
+	archiveutils "github.com/mudler/artemide/pkg/archive"
+	"github.com/mudler/artemide/pkg/context"
+	"github.com/mudler/artemide/pkg/osutil"
+	plugin "github.com/mudler/artemide/plugin"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+// Local starts the build from an existing rootfs, given as source.path:
+// a directory for the dir source, a stage3-like tarball for the tarball one
+type Local struct{}
+
+// Register subscribes to the dir and tarball sources
+func (l *Local) Register(bus *evbus.EventBus, context *context.Context) {
+	bus.Subscribe("artemide:start", Start)
+	bus.Subscribe(plugin.SourceTopic("dir"), copyDir)
+	bus.Subscribe(plugin.SourceTopic("tarball"), extractTarball)
+}
+
+func copyDir(e *plugin.Event) {
+	source := e.Context.Config.Source.Path
+	dir := e.State().Rootfs
+
+	if !osutil.ExistsDir(source) {
+		e.Fail(fmt.Errorf("%s is not a directory", source))
+		return
+	}
+
+	jww.INFO.Println("Copying", source, "to", dir)
+	if err := osutil.CopyTree(source, dir); err != nil {
+		e.Failf(err, "copying %s: {{err}}", source)
+		return
+	}
+}
+
+func extractTarball(e *plugin.Event) {
+	source := e.Context.Config.Source.Path
+	dir := e.State().Rootfs
+
+	f, err := os.Open(source)
+	if err != nil {
+		e.Fail(err)
+		return
+	}
+	defer f.Close()
+
+	jww.INFO.Println("Extracting", source, "to", dir)
+	if err := archiveutils.Extract(f, dir); err != nil {
+		e.Failf(err, "extracting %s: {{err}}", source)
+		return
+	}
+}
+
+func Start() {
+	jww.DEBUG.Printf("[recipe] Local is available")
+}
+
+func init() {
+	plugin.RegisterRecipe(&Local{})
+	plugin.HandlePathSource("dir")
+	plugin.HandlePathSource("tarball")
+}
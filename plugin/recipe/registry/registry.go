@@ -0,0 +1,84 @@
+package registry
+
+import (
+	evbus "github.com/asaskevich/EventBus"
+	"github.com/mudler/artemide/pkg/cache"
+	"github.com/mudler/artemide/pkg/context"
+	"github.com/mudler/artemide/pkg/registry"
+	plugin "github.com/mudler/artemide/plugin"
+	jww "github.com/spf13/jwalterweatherman"
+)
+
+// Registry unpacks images pulled straight from a docker registry, no docker daemon involved
+type Registry struct{}
+
+// Register subscribes to the registry source
+func (r *Registry) Register(bus *evbus.EventBus, context *context.Context) {
+	bus.Subscribe("artemide:start", Start)
+	bus.Subscribe(plugin.SourceTopic("registry"), unpack)
+}
+
+func unpack(e *plugin.Event) {
+	source := e.Context.Config.Source
+	dir := e.State().Rootfs
+
+	ref, err := registry.ParseReference(source.Image)
+	if err != nil {
+		e.Fail(err)
+		return
+	}
+
+	platform, err := source.TargetPlatform()
+	if err != nil {
+		e.Fail(err)
+		return
+	}
+
+	creds, err := registry.ResolveCredentials(ref.Registry, source.Username, source.PasswordEnv)
+	if err != nil {
+		e.Failf(err, "credentials of %s: {{err}}", ref.Registry)
+		return
+	}
+
+	client := registry.NewClient()
+	client.PlainHTTP = source.Insecure
+	client.Platform = platform
+	client.Credentials = creds
+
+	manifest, digest, err := client.Resolve(ref)
+	if err != nil {
+		e.Failf(err, "pulling %s: {{err}}", ref)
+		return
+	}
+
+	c, err := plugin.OpenCache(e.Context.Config.Cache)
+	if err != nil {
+		jww.WARN.Println("Cache disabled:", err)
+	}
+	key := cache.Key(digest, manifest.LayerDigests())
+	err = c.Unpack(key, cache.Entry{Image: ref.String(), Digest: digest}, dir, func() error {
+		jww.INFO.Printf("Pulling %s (%s), %d layers\n", ref, digest, len(manifest.Layers))
+		return client.Apply(ref, manifest, dir)
+	})
+	if err != nil {
+		e.Failf(err, "pulling %s: {{err}}", ref)
+		return
+	}
+	cfg, err := client.Config(ref, manifest.Config)
+	if err != nil {
+		e.Failf(err, "configuration of %s: {{err}}", ref)
+		return
+	}
+	jww.INFO.Println("Unpacked", ref, "("+digest+") to", dir)
+	e.Context.Set(plugin.SourceDigestKey, digest)
+	e.Context.Set(plugin.SourceConfigKey, cfg)
+}
+
+func Start() {
+	jww.DEBUG.Printf("[recipe] Registry is available")
+}
+
+func init() {
+	plugin.RegisterRecipe(&Registry{})
+	plugin.HandleSource("registry")
+}
@@ -1,24 +1,137 @@
 package script
 
 import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
 	evbus "github.com/asaskevich/EventBus"
 	"github.com/mudler/artemide/pkg/context"
+	"github.com/mudler/artemide/pkg/osutil"
+	"github.com/mudler/artemide/pkg/phase"
 	plugin "github.com/mudler/artemide/plugin"
 	jww "github.com/spf13/jwalterweatherman"
 )
 
-// Script construct the container arguments from the boson file
+// DefaultTimeout is how long a script may run when its event doesn't set a timeout
+const DefaultTimeout = 30 * time.Minute
+
+// Script runs the script actions of the recipe events, on the host or chrooted in the rootfs
 type Script struct{}
 
-// Process builds a list of packages from the boson file
-func (s *Script) Register(bus *evbus.EventBus, context *context.Context) { //returns args and volumes to mount
-	bus.Subscribe("artemide:start", Start)                                                  //Subscribing to artemide:start, Hello will be called
-	bus.Subscribe("artemide:artifact:recipe:script:event:after_unpack", afterUnpackHandler) //Subscribing to artemide:artifact:recipe:script:event:after_unpack, the After unpack handler
+// Register subscribes to the script events of every lifecycle phase
+func (s *Script) Register(bus *evbus.EventBus, context *context.Context) {
+	bus.Subscribe("artemide:start", Start)
+
+	// A script can be bound to any of the lifecycle phases
+	for _, p := range phase.All {
+		bus.Subscribe(plugin.EventTopic("script", p), eventHandler)
+	}
 }
 
-func afterUnpackHandler() {
-	jww.DEBUG.Printf("afterUnpackHandler() called")
+func eventHandler(e *plugin.Event) {
+	jww.DEBUG.Printf("eventHandler() called for %s (%s): %s", e.Artifact, e.Name, e.Action)
+
+	if err := run(e); err != nil {
+		e.Fail(err)
+	}
+}
+
+// run executes the action, the build informations are exported in its environment.
+// Actions bound to inside_chroot run chrooted in the artifact rootfs.
+func run(e *plugin.Event) error {
+	script, err := filepath.Abs(e.Action)
+	if err != nil {
+		return err
+	}
+	info, err := os.Stat(script)
+	if err != nil {
+		return fmt.Errorf("script %s not found: %s", e.Action, err)
+	}
+
+	rootfs, err := filepath.Abs(e.State().Rootfs)
+	if err != nil {
+		return err
+	}
+
+	timeout := e.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	prefix := "[" + e.Artifact + ":" + e.ID + "]"
+
+	if e.Name == phase.InsideChroot {
+		jww.INFO.Printf("[%s] Running %s chrooted in %s\n", e.Artifact, e.Action, rootfs)
+		return runInRoot(e, script, rootfs, timeout, prefix)
+	}
+
+	// Scripts missing the executable bit are handed to the shell
+	var cmd *exec.Cmd
+	if info.Mode()&0111 != 0 {
+		cmd = exec.Command(script)
+	} else {
+		cmd = exec.Command("sh", script)
+	}
+	cmd.Env = append(os.Environ(), environment(e, rootfs)...)
+
+	jww.INFO.Printf("[%s] Running %s (%s)\n", e.Artifact, e.Action, e.Name)
+	return osutil.RunStreamed(cmd, prefix, timeout, e.Context.Done())
+}
+
+// runInRoot copies the script in the rootfs, so it is reachable once chrooted, and runs it there
+func runInRoot(e *plugin.Event, script string, rootfs string, timeout time.Duration, prefix string) error {
+	copied, err := ioutil.TempFile(rootfs, ".artemide-script")
+	if err != nil {
+		return err
+	}
+	copied.Close()
+	defer os.Remove(copied.Name())
+
+	if err := osutil.Cp(script, copied.Name()); err != nil {
+		return err
+	}
+	// TempFile makes it private to root, the event user must read it
+	if err := os.Chmod(copied.Name(), 0755); err != nil {
+		return err
+	}
+
+	env := append([]string{"PATH=/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin", "HOME=/root"},
+		environment(e, "/")...)
+
+	return osutil.RunInRoot(rootfs, []string{"/bin/sh", "/" + filepath.Base(copied.Name())}, osutil.RootOptions{
+		Binds:        e.Config.Binds,
+		RoBinds:      e.Config.RoBinds,
+		User:         e.Config.User,
+		Group:        e.Config.Group,
+		Capabilities: e.Config.Capabilities,
+		Env:          env,
+		Timeout:      timeout,
+		Cancel:       e.Context.Done(),
+		LogPrefix:    prefix,
+	})
+}
 
+// environment describes the build to the scripts
+func environment(e *plugin.Event, rootfs string) []string {
+	env := []string{
+		"ARTEMIDE_ROOTFS=" + rootfs,
+		"ARTEMIDE_ARTIFACT=" + e.Artifact,
+		"ARTEMIDE_VENDOR=" + e.Context.Config.VendorString,
+		"ARTEMIDE_PHASE=" + e.Name,
+	}
+	if state := e.State(); state.Helpers != "" {
+		helpers, _ := filepath.Abs(state.Helpers)
+		if rootfs == "/" {
+			abs, _ := filepath.Abs(state.Rootfs)
+			rel, _ := filepath.Rel(abs, helpers)
+			helpers = "/" + rel
+		}
+		env = append(env, "ARTEMIDE_HELPERS="+helpers)
+	}
+	return env
 }
 
 func Start() {
@@ -27,4 +140,5 @@ func Start() {
 
 func init() {
 	plugin.RegisterRecipe(&Script{})
+	plugin.HandleRecipe("script")
 }
@@ -0,0 +1,291 @@
+package sdcard
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/template"
+
+	jww "github.com/spf13/jwalterweatherman"
+
+	config "github.com/mudler/artemide/pkg/config"
+	"github.com/mudler/artemide/pkg/disk"
+	"github.com/mudler/artemide/pkg/layer"
+	"github.com/mudler/artemide/pkg/uboot"
+)
+
+// Presets are the board settings known by name. The u-boot blobs are where the Debian
+// u-boot packages install them, set board.uboot for the other distributions.
+var Presets = map[string]config.Board{
+	"cubietruck": {
+		UBoot:       "/usr/lib/u-boot/Cubietruck/u-boot-sunxi-with-spl.bin",
+		UBootOffset: "8K",
+		Kernel:      "zImage",
+		FDT:         "dtbs/sun7i-a20-cubietruck.dtb",
+		Cmdline:     "console=ttyS0,115200 root=/dev/mmcblk0p2 rootwait rw",
+	},
+	"orangepi-pc": {
+		UBoot:       "/usr/lib/u-boot/orangepi_pc/u-boot-sunxi-with-spl.bin",
+		UBootOffset: "8K",
+		Kernel:      "zImage",
+		FDT:         "dtbs/sun8i-h3-orangepi-pc.dtb",
+		Cmdline:     "console=ttyS0,115200 root=/dev/mmcblk0p2 rootwait rw",
+	},
+	"wandboard": {
+		UBoot:       "/usr/lib/u-boot/wandboard/u-boot.imx",
+		UBootOffset: "1K",
+		Kernel:      "zImage",
+		FDT:         "dtbs/imx6q-wandboard.dtb",
+		Cmdline:     "console=ttymxc0,115200 root=/dev/mmcblk0p2 rootwait rw",
+	},
+	// The boot ROM loads MLO from the boot partition, no raw blob
+	"beaglebone-black": {
+		Files:   []string{"/usr/lib/u-boot/am335x_boneblack/MLO", "/usr/lib/u-boot/am335x_boneblack/u-boot.img"},
+		Kernel:  "zImage",
+		FDT:     "dtbs/am335x-boneblack.dtb",
+		Cmdline: "console=ttyS0,115200 root=/dev/mmcblk0p2 rootwait rw",
+	},
+}
+
+// defaultScript boots the kernel from the partition the script was found on, by the distro boot of u-boot
+const defaultScript = `# Generated by artemide for {{.Artifact}}
+setenv bootargs "{{.Cmdline}}"
+load ${devtype} ${devnum}:${distro_bootpart} ${kernel_addr_r} {{.Kernel}}
+{{- if .FDT}}
+load ${devtype} ${devnum}:${distro_bootpart} ${fdt_addr_r} {{.FDT}}
+{{.Boot}} ${kernel_addr_r} - ${fdt_addr_r}
+{{- else}}
+{{.Boot}} ${kernel_addr_r}
+{{- end}}
+`
+
+// scriptData is what the boot script templates are executed with
+type scriptData struct {
+	Artifact string
+	Kernel   string
+	FDT      string
+	Cmdline  string
+	Boot     string // bootz on arm, booti on arm64
+}
+
+// resolveBoard fills what the board settings leave unset from their preset
+func resolveBoard(b config.Board) (config.Board, error) {
+	if b.Preset == "" {
+		return b, nil
+	}
+	p, ok := Presets[b.Preset]
+	if !ok {
+		var names []string
+		for name := range Presets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return b, fmt.Errorf("unknown board preset %q (expected one of %v)", b.Preset, names)
+	}
+	if b.UBoot == "" {
+		b.UBoot = p.UBoot
+	}
+	if b.UBootOffset == "" {
+		b.UBootOffset = p.UBootOffset
+	}
+	if b.Files == nil {
+		b.Files = p.Files
+	}
+	if b.Kernel == "" {
+		b.Kernel = p.Kernel
+	}
+	if b.FDT == "" {
+		b.FDT = p.FDT
+	}
+	if b.Cmdline == "" {
+		b.Cmdline = p.Cmdline
+	}
+	return b, nil
+}
+
+// stagesBoot tells if the boot partition gets more than the boot directory
+func stagesBoot(b config.Board) bool {
+	return len(b.Files) > 0 || b.Kernel != "" || b.BootScript != ""
+}
+
+// stageBoot assembles the content of the boot partition in dir: the boot directory of the
+// rootfs, the board files and the boot script
+func stageBoot(dir string, rootfs string, s settings) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	if boot, err := layer.SecureJoin(rootfs, s.bootDir); err != nil {
+		return err
+	} else if _, err := os.Stat(boot); err == nil {
+		if err := copyFromRoot(rootfs, s.bootDir, dir); err != nil {
+			return fmt.Errorf("copying %s: %s", s.bootDir, err)
+		}
+	}
+
+	for _, f := range s.board.Files {
+		spec := strings.SplitN(f, ":", 2)
+		dest := dir
+		if len(spec) == 2 {
+			dest = filepath.Join(dir, spec[1])
+			if rel, err := filepath.Rel(dir, dest); err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+				return fmt.Errorf("board file %s: %s is out of the boot partition", spec[0], spec[1])
+			}
+		}
+		// Listed from the host, resolved again in the rootfs when copied
+		matches, err := filepath.Glob(filepath.Join(rootfs, filepath.Clean("/"+spec[0])))
+		if err != nil {
+			return err
+		}
+		if len(matches) == 0 {
+			return fmt.Errorf("board file %s is not in the rootfs", spec[0])
+		}
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			return err
+		}
+		for _, m := range matches {
+			rel, err := filepath.Rel(rootfs, m)
+			if err != nil {
+				return err
+			}
+			if err := copyFromRoot(rootfs, rel, filepath.Join(dest, filepath.Base(m))); err != nil {
+				return fmt.Errorf("copying %s: %s", rel, err)
+			}
+		}
+	}
+
+	if s.board.Kernel == "" && s.board.BootScript == "" {
+		return nil
+	}
+	return writeBootScript(dir, s)
+}
+
+// maxDepth bounds the directories copyFromRoot descends, symlinks can make loops
+const maxDepth = 64
+
+// copyFromRoot copies src, a path of the rootfs, to dest. vfat has no links, they are
+// followed, but resolved in the rootfs like layer.SecureJoin does: never to the host files.
+func copyFromRoot(rootfs string, src string, dest string) error {
+	return copyResolved(rootfs, src, dest, 0)
+}
+
+func copyResolved(rootfs string, src string, dest string, depth int) error {
+	path, err := layer.SecureJoin(rootfs, src)
+	if err != nil {
+		return err
+	}
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) && depth > 0 {
+		jww.WARN.Println("Skipping", src+", it links to nothing in the rootfs")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case fi.IsDir():
+		if depth > maxDepth {
+			return fmt.Errorf("%s is nested too deep, is there a symlink loop?", src)
+		}
+		if err := os.MkdirAll(dest, 0755); err != nil {
+			return err
+		}
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		for _, e := range entries {
+			if err := copyResolved(rootfs, filepath.Join(src, e.Name()), filepath.Join(dest, e.Name()), depth+1); err != nil {
+				return err
+			}
+		}
+		return nil
+	case fi.Mode().IsRegular():
+		return copyFile(path, dest, fi.Mode().Perm())
+	}
+	// Devices, sockets and fifos have no place on vfat
+	return nil
+}
+
+func copyFile(src string, dest string, perm os.FileMode) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// writeBootScript executes the boot script template, and writes it as boot.cmd and boot.scr
+func writeBootScript(dir string, s settings) error {
+	text := defaultScript
+	if s.board.BootScript != "" {
+		b, err := ioutil.ReadFile(s.board.BootScript)
+		if err != nil {
+			return err
+		}
+		text = string(b)
+	}
+	tmpl, err := template.New("boot.cmd").Parse(text)
+	if err != nil {
+		return err
+	}
+	data := scriptData{
+		Artifact: s.artifact,
+		Kernel:   s.board.Kernel,
+		FDT:      s.board.FDT,
+		Cmdline:  s.board.Cmdline,
+		Boot:     "bootz",
+	}
+	if s.arch == "arm64" {
+		data.Boot = "booti"
+	}
+	var cmd bytes.Buffer
+	if err := tmpl.Execute(&cmd, data); err != nil {
+		return err
+	}
+
+	scr, err := uboot.Script(cmd.Bytes(), "boot script", s.arch)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "boot.cmd"), cmd.Bytes(), 0644); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, "boot.scr"), scr, 0644)
+}
+
+// writeUBoot writes the bootloader blob of the rootfs at its offset, between the partition
+// table and the first partition
+func writeUBoot(f *os.File, rootfs string, s settings, firstPartition int64) error {
+	path, err := layer.SecureJoin(rootfs, s.board.UBoot)
+	if err != nil {
+		return err
+	}
+	blob, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("u-boot blob: %s", err)
+	}
+	tableEnd, _ := disk.Reserved(s.table)
+	if s.ubootOffset < tableEnd {
+		return fmt.Errorf("u-boot at %d overlaps the %s partition table, which ends at %d", s.ubootOffset, s.table, tableEnd)
+	}
+	if s.ubootOffset+int64(len(blob)) > firstPartition {
+		return fmt.Errorf("u-boot at %d, %d bytes, overlaps the first partition at %d: move sdcard.start", s.ubootOffset, len(blob), firstPartition)
+	}
+	_, err = f.WriteAt(blob, s.ubootOffset)
+	return err
+}
@@ -0,0 +1,275 @@
+package sdcard
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	evbus "github.com/asaskevich/EventBus"
+	jww "github.com/spf13/jwalterweatherman"
+
+	config "github.com/mudler/artemide/pkg/config"
+	"github.com/mudler/artemide/pkg/context"
+	"github.com/mudler/artemide/pkg/disk"
+	"github.com/mudler/artemide/pkg/image"
+	"github.com/mudler/artemide/pkg/layer"
+	"github.com/mudler/artemide/pkg/units"
+	plugin "github.com/mudler/artemide/plugin"
+)
+
+// Type is the artifact type writing the rootfs to a raw disk image, for the boards booting from sd-cards
+const Type = "sdcard"
+
+// SDCard builds the sdcard artifacts
+type SDCard struct{}
+
+// Register subscribes to the packaging of the sdcard artifacts
+func (s *SDCard) Register(bus *evbus.EventBus, context *context.Context) {
+	bus.Subscribe("artemide:start", Start)
+	bus.Subscribe(plugin.PackageTopic(Type), build)
+}
+
+// settings are the [artifact.<name>.sdcard] values, parsed and defaulted
+type settings struct {
+	artifact  string
+	file      string
+	table     string
+	size      int64
+	start     int64
+	bootSize  int64
+	bootDir   string
+	bootLabel string
+	rootLabel string
+
+	board       config.Board // resolved from its preset
+	ubootOffset int64
+	arch        string // of the boot script
+}
+
+func parse(artifact string, a config.Artifact, arch string) (settings, error) {
+	s := a.SDCard
+	parsed := settings{
+		artifact:  artifact,
+		arch:      arch,
+		file:      s.File,
+		table:     s.Table,
+		start:     config.DefaultSDCardStart,
+		bootSize:  config.DefaultSDCardBootSize,
+		bootDir:   s.BootDir,
+		bootLabel: s.BootLabel,
+		rootLabel: s.RootLabel,
+	}
+	if parsed.file == "" {
+		parsed.file = artifact + ".img"
+	}
+	if parsed.table == "" {
+		parsed.table = disk.MBR
+	}
+	if parsed.bootDir == "" {
+		parsed.bootDir = "/boot"
+	}
+	if parsed.bootLabel == "" {
+		parsed.bootLabel = "BOOT"
+	}
+	if filepath.Clean("/"+parsed.bootDir) == "/" {
+		return parsed, fmt.Errorf("the boot directory can't be the root of the rootfs")
+	}
+	if parsed.rootLabel == "" {
+		parsed.rootLabel = "rootfs"
+	}
+
+	var err error
+	if parsed.size, err = units.ParseSize(s.Size); err != nil {
+		return parsed, err
+	}
+	if s.Start != "" {
+		if parsed.start, err = units.ParseSize(s.Start); err != nil {
+			return parsed, err
+		}
+	}
+	if s.BootSize != "" {
+		if parsed.bootSize, err = units.ParseSize(s.BootSize); err != nil {
+			return parsed, err
+		}
+	}
+
+	if parsed.board, err = resolveBoard(a.Board); err != nil {
+		return parsed, err
+	}
+	if parsed.board.UBoot != "" {
+		if parsed.ubootOffset, err = units.ParseSize(parsed.board.UBootOffset); err != nil {
+			return parsed, fmt.Errorf("u-boot offset: %s", err)
+		}
+	}
+	if parsed.bootSize == 0 && stagesBoot(parsed.board) {
+		return parsed, fmt.Errorf("the board files and boot script need a boot partition")
+	}
+	return parsed, nil
+}
+
+// partitions lays out the boot partition, when there is one, and the root partition
+func (s settings) partitions() ([]disk.Partition, error) {
+	return disk.Layout(s.table, s.size, s.start, s.bootSize)
+}
+
+func build(e *plugin.Event) {
+	state := e.State()
+	s, err := parse(e.Artifact, e.Context.Config.Artifacts[e.Artifact], arch(e))
+	if err != nil {
+		e.Fail(err)
+		return
+	}
+	img := filepath.Join(state.Output, s.file)
+	jww.INFO.Printf("[%s] Writing %s, %s with a %s partition table\n", e.Artifact, img, units.FormatSize(s.size), s.table)
+	if err := write(img, state.Rootfs, s); err != nil {
+		os.Remove(img)
+		e.Failf(err, "writing %s: {{err}}", img)
+		return
+	}
+	state.AddOutput(img)
+	jww.INFO.Printf("[%s] Wrote %s\n", e.Artifact, img)
+}
+
+// write makes the filesystems in temporary files next to the rootfs, then assembles the image
+func write(img string, rootfs string, s settings) error {
+	parts, err := s.partitions()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempDir(filepath.Dir(filepath.Clean(rootfs)), "sdcard")
+	if err != nil {
+		return err
+	}
+	// Left alone when the boot directory could not be moved back, it is the only copy
+	restored := true
+	defer func() {
+		if restored {
+			os.RemoveAll(tmp)
+		}
+	}()
+
+	var filesystems []string
+	// Moved aside while the root filesystem is made: its parents resolve in the rootfs, it is not followed
+	clean := filepath.Clean("/" + s.bootDir)
+	parent, err := layer.SecureJoin(rootfs, filepath.Dir(clean))
+	if err != nil {
+		return err
+	}
+	boot := filepath.Join(parent, filepath.Base(clean))
+	if s.bootSize > 0 {
+		// Always staged, mcopy would follow the links of the rootfs to the host files
+		content := filepath.Join(tmp, "bootfs")
+		if err := stageBoot(content, rootfs, s); err != nil {
+			return err
+		}
+		fs := filepath.Join(tmp, "boot.img")
+		jww.INFO.Printf("Making the boot filesystem from %s\n", s.bootDir)
+		// The table says which FAT the bootloaders find in it
+		if parts[0].Kind, err = disk.MakeVfat(fs, parts[0].Size, s.bootLabel, content); err != nil {
+			return err
+		}
+		filesystems = append(filesystems, fs)
+	}
+
+	fs := filepath.Join(tmp, "root.img")
+	jww.INFO.Println("Making the root filesystem")
+	err = withoutDir(boot, tmp, s.bootSize > 0, func() error {
+		return disk.MakeExt4(fs, parts[len(parts)-1].Size, s.rootLabel, rootfs)
+	})
+	if _, ok := err.(*restoreError); ok {
+		restored = false
+	}
+	if err != nil {
+		return err
+	}
+	filesystems = append(filesystems, fs)
+
+	f, err := os.Create(img)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(s.size); err != nil {
+		return err
+	}
+	if err := disk.WriteTable(f, s.table, s.size, parts); err != nil {
+		return err
+	}
+	for i, fs := range filesystems {
+		if err := disk.CopyAt(f, parts[i].Start, fs); err != nil {
+			return err
+		}
+	}
+	if s.board.UBoot != "" {
+		jww.INFO.Printf("Writing u-boot %s at %d\n", s.board.UBoot, s.ubootOffset)
+		if err := writeUBoot(f, rootfs, s, parts[0].Start); err != nil {
+			return err
+		}
+	}
+	return f.Close()
+}
+
+// restoreError is returned when the hidden directory could not be moved back
+type restoreError struct {
+	aside string
+	dir   string
+	err   error
+}
+
+func (e *restoreError) Error() string {
+	return fmt.Sprintf("the content of %s is left in %s: %s", e.dir, e.aside, e.err)
+}
+
+// withoutDir runs fn with dir empty when hide is set, its content is in the boot partition.
+// It is moved to tmp, on the same filesystem, and back: a *restoreError tells it is still in tmp.
+func withoutDir(dir string, tmp string, hide bool, fn func() error) (err error) {
+	fi, err := os.Stat(dir)
+	if !hide || os.IsNotExist(err) {
+		return fn()
+	}
+	if err != nil {
+		return err
+	}
+	aside := filepath.Join(tmp, "boot")
+	if err := os.Rename(dir, aside); err != nil {
+		return err
+	}
+	defer func() {
+		os.Remove(dir)
+		if rerr := os.Rename(aside, dir); rerr != nil {
+			if err != nil {
+				jww.ERROR.Println(err)
+			}
+			err = &restoreError{aside: aside, dir: dir, err: rerr}
+		}
+	}()
+	// The mount point stays
+	if err := os.Mkdir(dir, fi.Mode().Perm()); err != nil {
+		return err
+	}
+	return fn()
+}
+
+// arch is the architecture the artifact is built for: the one of the source image, when known
+func arch(e *plugin.Event) string {
+	if v, ok := e.Context.Get(plugin.SourceConfigKey); ok {
+		if cfg, ok := v.(image.Config); ok && cfg.Architecture != "" {
+			return cfg.Architecture
+		}
+	}
+	if platform, err := e.Context.Config.Source.TargetPlatform(); err == nil && platform.Architecture != "" {
+		return platform.Architecture
+	}
+	return "arm"
+}
+
+func Start() {
+	jww.DEBUG.Printf("[recipe] SDCard is available")
+}
+
+func init() {
+	plugin.RegisterRecipe(&SDCard{})
+	plugin.HandleArtifactType(Type)
+}